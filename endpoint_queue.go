@@ -0,0 +1,377 @@
+package endpoint_queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+type Action string
+
+const (
+	Add    Action = "add"
+	Remove Action = "remove"
+)
+
+// Event is an endpoint change waiting to be delivered to the policy broker.
+type Event struct {
+	Seq       uint64 `json:"seq"`
+	Container string `json:"container"`
+	Action    Action `json:"action"`
+	Space     string `json:"space,omitempty"`
+	Endpoint  string `json:"endpoint"`
+	Attempts  int    `json:"attempts"`
+
+	// RequestID is sent with every delivery attempt, tying the broker's logs
+	// to the garden call that caused the event.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Queue delivers endpoint events to the policy broker in the background.
+// Events are persisted before Enqueue returns and only removed once the
+// broker accepted them, so they survive restarts. Events for one endpoint
+// are delivered in order, whichever container they come from, so that a
+// port's removal from the container that released it cannot overtake its
+// registration by the next container; an endpoint whose head event keeps
+// failing does not hold up the others.
+type Queue struct {
+	filePath   string
+	client     policyclient.Client
+	logger     lager.Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mutex   sync.Mutex
+	nextSeq uint64
+	pending map[string][]Event // by endpoint
+	retryAt map[string]time.Time
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(filePath string, client policyclient.Client, minBackoff, maxBackoff time.Duration, logger lager.Logger) (*Queue, error) {
+	q := &Queue{
+		filePath:   filePath,
+		client:     client,
+		logger:     logger.Session("endpoint-queue"),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		pending:    make(map[string][]Event),
+		retryAt:    make(map[string]time.Time),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	events, err := load(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		q.pending[event.Endpoint] = append(q.pending[event.Endpoint], event)
+		if event.Seq >= q.nextSeq {
+			q.nextSeq = event.Seq + 1
+		}
+	}
+
+	if len(events) > 0 {
+		q.logger.Info("loaded", lager.Data{"pending": len(events)})
+	}
+
+	return q, nil
+}
+
+func (q *Queue) Register(ctx context.Context, container, space, endpoint string) error {
+	return q.Enqueue(Event{Container: container, Action: Add, Space: space, Endpoint: endpoint, RequestID: policyclient.RequestID(ctx)})
+}
+
+func (q *Queue) Deregister(ctx context.Context, container, endpoint string) error {
+	return q.Enqueue(Event{Container: container, Action: Remove, Endpoint: endpoint, RequestID: policyclient.RequestID(ctx)})
+}
+
+func (q *Queue) Enqueue(event Event) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.enqueue(event)
+}
+
+// enqueue must be called with the mutex held.
+func (q *Queue) enqueue(event Event) error {
+	event.Seq = q.nextSeq
+	event.Attempts = 0
+
+	q.pending[event.Endpoint] = append(q.pending[event.Endpoint], event)
+
+	if err := q.save(); err != nil {
+		q.pending[event.Endpoint] = q.pending[event.Endpoint][:len(q.pending[event.Endpoint])-1]
+		if len(q.pending[event.Endpoint]) == 0 {
+			delete(q.pending, event.Endpoint)
+		}
+		return err
+	}
+
+	q.nextSeq++
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending returns the number of undelivered events.
+func (q *Queue) Pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	count := 0
+	for _, events := range q.pending {
+		count += len(events)
+	}
+
+	return count
+}
+
+func (q *Queue) Start() {
+	go q.run()
+}
+
+func (q *Queue) Stop() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		next := q.deliverDue()
+
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// deliverDue delivers the head event of every endpoint that is not backing
+// off, until there is nothing left to do right now. It returns when the next
+// retry is due, or zero if nothing is pending.
+func (q *Queue) deliverDue() time.Time {
+	for {
+		event, found := q.nextDue()
+		if !found {
+			break
+		}
+
+		select {
+		case <-q.stop:
+			return time.Time{}
+		default:
+		}
+
+		err := q.deliver(event)
+		q.complete(event, err)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var next time.Time
+	for endpoint := range q.pending {
+		at := q.retryAt[endpoint]
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+
+	return next
+}
+
+func (q *Queue) nextDue() (Event, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+
+	var due []Event
+	for endpoint, events := range q.pending {
+		if !q.retryAt[endpoint].After(now) {
+			due = append(due, events[0])
+		}
+	}
+
+	if len(due) == 0 {
+		return Event{}, false
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].Seq < due[j].Seq })
+
+	return due[0], true
+}
+
+func (q *Queue) deliver(event Event) error {
+	ctx := policyclient.WithRequestID(context.Background(), event.RequestID)
+
+	switch event.Action {
+	case Add:
+		_, err := q.client.RegisterEndpoint(ctx, event.Space, event.Endpoint)
+		return err
+	case Remove:
+		return q.client.DeregisterEndpoint(ctx, event.Endpoint)
+	}
+
+	return fmt.Errorf("unknown action %q", event.Action)
+}
+
+func (q *Queue) complete(event Event, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	data := lager.Data{
+		"container":  event.Container,
+		"action":     event.Action,
+		"space":      event.Space,
+		"endpoint":   event.Endpoint,
+		"request-id": event.RequestID,
+	}
+
+	if err != nil && !isPermanent(err) {
+		event.Attempts++
+		q.pending[event.Endpoint][0] = event
+
+		backoff := q.minBackoff << uint(event.Attempts-1)
+		if backoff > q.maxBackoff || backoff <= 0 {
+			backoff = q.maxBackoff
+		}
+		q.retryAt[event.Endpoint] = time.Now().Add(backoff)
+
+		data["attempts"] = event.Attempts
+		data["retry-in"] = backoff.String()
+		q.logger.Error("delivery-failed", err, data)
+
+		if saveErr := q.save(); saveErr != nil {
+			q.logger.Error("failed-to-save", saveErr)
+		}
+		return
+	}
+
+	if err != nil {
+		q.logger.Error("dropped-rejected-event", err, data)
+	} else {
+		q.logger.Debug("delivered", data)
+	}
+
+	q.pending[event.Endpoint] = q.pending[event.Endpoint][1:]
+	if len(q.pending[event.Endpoint]) == 0 {
+		delete(q.pending, event.Endpoint)
+	}
+	delete(q.retryAt, event.Endpoint)
+
+	if saveErr := q.save(); saveErr != nil {
+		q.logger.Error("failed-to-save", saveErr)
+	}
+}
+
+// isPermanent is true for broker rejections of the event itself, which a
+// retry cannot fix. Other 4xx, such as 401 and 403 from a misconfigured
+// token or 429 from an overloaded broker, go away without the event
+// changing, so the event is kept and retried.
+func isPermanent(err error) bool {
+	brokerErr, ok := err.(policyclient.Error)
+	if !ok {
+		return false
+	}
+
+	switch brokerErr.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+
+	return false
+}
+
+// save must be called with the mutex held.
+func (q *Queue) save() error {
+	events := []Event{}
+	for _, pending := range q.pending {
+		events = append(events, pending...)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(q.filePath), filepath.Base(q.filePath)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating queue file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := json.NewEncoder(tmpFile).Encode(events); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("writing queue file: %s", err)
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("syncing queue file: %s", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing queue file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), q.filePath); err != nil {
+		return fmt.Errorf("renaming queue file: %s", err)
+	}
+
+	return nil
+}
+
+func load(filePath string) ([]Event, error) {
+	queueFile, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening queue file: %s", err)
+	}
+	defer queueFile.Close()
+
+	var events []Event
+	if err := json.NewDecoder(queueFile).Decode(&events); err != nil {
+		return nil, fmt.Errorf("parsing queue file: %s", err)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+
+	return events, nil
+}
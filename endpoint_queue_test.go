@@ -0,0 +1,199 @@
+package endpoint_queue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+// fakeClient records the endpoint calls it gets and fails them with the
+// errors queued for their endpoint.
+type fakeClient struct {
+	mutex    sync.Mutex
+	failures map[string][]error
+	calls    []string
+}
+
+func (c *fakeClient) SpacePolicy(ctx context.Context, space string) (policyclient.SpacePolicy, error) {
+	return policyclient.SpacePolicy{}, nil
+}
+
+func (c *fakeClient) Groups(ctx context.Context) ([]policyclient.Group, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) RegisterEndpoint(ctx context.Context, space string, endpoint string) (policyclient.Endpoint, error) {
+	return policyclient.Endpoint{}, c.call("add", endpoint)
+}
+
+func (c *fakeClient) DeregisterEndpoint(ctx context.Context, endpoint string) error {
+	return c.call("remove", endpoint)
+}
+
+func (c *fakeClient) Reconcile(ctx context.Context, req policyclient.ReconcileRequest) (policyclient.ReconcileResult, error) {
+	return policyclient.ReconcileResult{}, nil
+}
+
+func (c *fakeClient) Ready(ctx context.Context) (policyclient.Readiness, error) {
+	return policyclient.Readiness{}, nil
+}
+
+func (c *fakeClient) call(action, endpoint string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.calls = append(c.calls, action+" "+endpoint)
+
+	failures := c.failures[endpoint]
+	if len(failures) == 0 {
+		return nil
+	}
+
+	c.failures[endpoint] = failures[1:]
+	return failures[0]
+}
+
+func (c *fakeClient) recorded() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.calls...)
+}
+
+func newTestQueue(t *testing.T, filePath string, client *fakeClient) *Queue {
+	queue, err := New(filePath, client, 50*time.Millisecond, 100*time.Millisecond, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return queue
+}
+
+func waitForPending(t *testing.T, queue *Queue, pending int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Pending() != pending {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending events, got %d", pending, queue.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventsForAnEndpointAreDeliveredInOrder(t *testing.T) {
+	client := &fakeClient{failures: map[string][]error{
+		"10.0.0.1:60000": {errors.New("connection refused")},
+	}}
+	queue := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"), client)
+
+	ctx := context.Background()
+	for _, enqueue := range []func() error{
+		func() error { return queue.Register(ctx, "container-a", "space", "10.0.0.1:60000") },
+		func() error { return queue.Deregister(ctx, "container-a", "10.0.0.1:60000") },
+		func() error { return queue.Register(ctx, "container-b", "space", "10.0.0.1:60000") },
+		func() error { return queue.Register(ctx, "container-c", "space", "10.0.0.1:60001") },
+	} {
+		if err := enqueue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queue.Start()
+	defer queue.Stop()
+
+	waitForPending(t, queue, 0)
+
+	// the port's removal from container-a cannot overtake its first
+	// registration, nor container-b's registration the removal; the other
+	// endpoint does not wait for the failing one
+	want := []string{
+		"add 10.0.0.1:60000",
+		"add 10.0.0.1:60001",
+		"add 10.0.0.1:60000",
+		"remove 10.0.0.1:60000",
+		"add 10.0.0.1:60000",
+	}
+	if got := client.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls %v, want %v", got, want)
+	}
+}
+
+func TestEventsSurviveRestarts(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "queue.json")
+
+	queue := newTestQueue(t, filePath, &fakeClient{})
+	if err := queue.Register(context.Background(), "container-a", "space", "10.0.0.1:60000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Deregister(context.Background(), "container-a", "10.0.0.1:60000"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{}
+	restarted := newTestQueue(t, filePath, client)
+	if got := restarted.Pending(); got != 2 {
+		t.Fatalf("%d pending events after restart, want 2", got)
+	}
+
+	// queued after the loaded events, so delivered after them
+	if err := restarted.Register(context.Background(), "container-b", "space", "10.0.0.1:60000"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted.Start()
+	waitForPending(t, restarted, 0)
+	restarted.Stop()
+
+	want := []string{"add 10.0.0.1:60000", "remove 10.0.0.1:60000", "add 10.0.0.1:60000"}
+	if got := client.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls %v, want %v", got, want)
+	}
+
+	if got := newTestQueue(t, filePath, &fakeClient{}).Pending(); got != 0 {
+		t.Errorf("%d pending events after delivering them all, want 0", got)
+	}
+}
+
+func TestFailedEventsAreRetried(t *testing.T) {
+	client := &fakeClient{failures: map[string][]error{
+		"10.0.0.1:60000": {
+			policyclient.Error{StatusCode: http.StatusUnauthorized, Message: "bad token"},
+			policyclient.Error{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"},
+		},
+		"10.0.0.1:60001": {
+			policyclient.Error{StatusCode: http.StatusNotFound, Message: "no such space"},
+		},
+	}}
+	queue := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"), client)
+
+	if err := queue.Register(context.Background(), "container-a", "space", "10.0.0.1:60000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Register(context.Background(), "container-a", "missing", "10.0.0.1:60001"); err != nil {
+		t.Fatal(err)
+	}
+
+	queue.Start()
+	defer queue.Stop()
+
+	waitForPending(t, queue, 0)
+
+	// the rejected registration is dropped after one attempt, the others
+	// are retried until the broker accepts them
+	want := []string{
+		"add 10.0.0.1:60000",
+		"add 10.0.0.1:60001",
+		"add 10.0.0.1:60000",
+		"add 10.0.0.1:60000",
+	}
+	if got := client.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+package port_pool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+// builtInGroupNames are the groups of a policy broker started without a
+// config, in pool ID order.
+var builtInGroupNames = []string{"blue", "green", "red"}
+
+// LayoutConfig says where the port pool groups come from, in order of
+// precedence: the broker's groups and their port ranges, a layout file, or
+// Size ports from Start split into one equal group per name.
+type LayoutConfig struct {
+	FromBroker bool
+	File       string
+
+	Start uint32
+	Size  uint32
+	// Names defaults to the broker's group names in pool ID order. Groups,
+	// unless 0, is how many names there must be.
+	Names  []string
+	Groups uint
+
+	// RequireBroker refuses to fall back to the saved layout when the layout
+	// or its names have to come from the broker and it is unreachable.
+	RequireBroker bool
+	// StatePath is the port pool state file, whose layout is the fallback.
+	StatePath string
+}
+
+// ResolveLayout returns the port pool groups described by config. It checks
+// that every group the broker can classify a space into exists. When the
+// layout or its names have to come from the broker and it is unreachable,
+// the layout saved in the port pool state is kept, or else the pool is split
+// between the broker's built-in groups.
+func ResolveLayout(logger lager.Logger, client policyclient.Client, config LayoutConfig) ([]Group, error) {
+	logger = logger.Session("resolve-port-pool-layout")
+
+	ctx := policyclient.WithRequestID(context.Background(), policyclient.NewRequestID())
+	brokerGroups, brokerErr := client.Groups(ctx)
+	if brokerErr != nil {
+		logger.Error("failed-to-fetch-broker-groups", brokerErr)
+	}
+
+	sort.Slice(brokerGroups, func(i, j int) bool { return brokerGroups[i].PoolID < brokerGroups[j].PoolID })
+
+	needsBroker := config.FromBroker || (config.File == "" && len(config.Names) == 0)
+	if needsBroker && brokerErr != nil && config.RequireBroker {
+		return nil, fmt.Errorf("port_pool: the policy broker is required but its groups are unavailable: %s", brokerErr)
+	}
+
+	var layout []Group
+	switch {
+	case needsBroker && brokerErr != nil:
+		var err error
+		layout, err = fallbackLayout(logger, config)
+		if err != nil {
+			return nil, err
+		}
+
+	case config.FromBroker:
+		var err error
+		layout, err = brokerLayout(brokerGroups)
+		if err != nil {
+			return nil, err
+		}
+
+	case config.File != "":
+		var err error
+		layout, err = LoadLayout(config.File)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		names := config.Names
+		if len(names) == 0 {
+			for _, group := range brokerGroups {
+				names = append(names, group.Name)
+			}
+		}
+
+		if config.Groups != 0 && uint(len(names)) != config.Groups {
+			return nil, fmt.Errorf("port_pool: %d groups configured but there are %d group names: %v", config.Groups, len(names), names)
+		}
+
+		var err error
+		layout, err = Uniform(config.Start, config.Size, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := Validate(layout); err != nil {
+		return nil, err
+	}
+
+	for _, group := range brokerGroups {
+		var poolGroup *Group
+		for i := range layout {
+			if layout[i].Name == group.Name {
+				poolGroup = &layout[i]
+			}
+		}
+
+		if poolGroup == nil {
+			return nil, fmt.Errorf("port_pool: policy broker group %s is not one of the port pool groups", group.Name)
+		}
+
+		if ranges := brokerRanges(group); ranges != fmt.Sprint(poolGroup.Ranges) {
+			logger.Info("ranges-differ-from-broker", lager.Data{"group": group.Name, "broker": ranges, "garden": fmt.Sprint(poolGroup.Ranges)})
+		}
+	}
+
+	logger.Info("resolved", lager.Data{"groups": len(layout), "broker-groups": len(brokerGroups)})
+
+	return layout, nil
+}
+
+// fallbackLayout is the layout used when the broker needed for it is
+// unreachable: the one saved in the port pool state, so that the
+// allocations in it stay valid, or else the pool split between the broker's
+// built-in groups.
+func fallbackLayout(logger lager.Logger, config LayoutConfig) ([]Group, error) {
+	state, err := LoadState(config.StatePath, nil)
+	if err != nil {
+		logger.Error("failed-to-load-saved-layout", err)
+	}
+
+	if len(state.Layout) > 0 {
+		logger.Info("using-saved-layout", lager.Data{"groups": len(state.Layout)})
+		return state.Layout, nil
+	}
+
+	logger.Info("using-built-in-group-names", lager.Data{"names": builtInGroupNames})
+
+	return Uniform(config.Start, config.Size, builtInGroupNames)
+}
+
+// brokerLayout turns the broker's groups into port pool groups of the same
+// name.
+func brokerLayout(groups []policyclient.Group) ([]Group, error) {
+	layout := make([]Group, 0, len(groups))
+	for _, group := range groups {
+		ranges := make([]Range, 0, len(group.PortRanges))
+		for _, portRange := range group.PortRanges {
+			start, size, err := policyclient.ParsePortRange(portRange)
+			if err != nil {
+				return nil, fmt.Errorf("port_pool: policy broker group %s: %s", group.Name, err)
+			}
+			ranges = append(ranges, Range{Start: start, Size: size})
+		}
+
+		layout = append(layout, Group{Name: group.Name, Ranges: ranges})
+	}
+
+	return layout, nil
+}
+
+func brokerRanges(group policyclient.Group) string {
+	ranges := make([]Range, 0, len(group.PortRanges))
+	for _, portRange := range group.PortRanges {
+		if start, size, err := policyclient.ParsePortRange(portRange); err == nil {
+			ranges = append(ranges, Range{Start: start, Size: size})
+		}
+	}
+	return fmt.Sprint(ranges)
+}
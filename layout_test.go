@@ -0,0 +1,133 @@
+package port_pool
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+// fakeClient serves the broker's groups, or fails if err is set.
+type fakeClient struct {
+	policyclient.Client
+	groups []policyclient.Group
+	err    error
+}
+
+func (c fakeClient) Groups(ctx context.Context) ([]policyclient.Group, error) {
+	return c.groups, c.err
+}
+
+var brokerGroups = []policyclient.Group{
+	{Name: "red", PoolID: 2, PortRanges: []string{"63488/1023"}},
+	{Name: "blue", PoolID: 0, PortRanges: []string{"59392/1024", "60416/1024"}},
+	{Name: "green", PoolID: 1, PortRanges: []string{"61440/1024"}},
+}
+
+var unreachable = fakeClient{err: errors.New("connection refused")}
+
+func testConfig(t *testing.T) LayoutConfig {
+	return LayoutConfig{Start: 60000, Size: 3000, StatePath: filepath.Join(t.TempDir(), "port_pool.json")}
+}
+
+func TestResolveLayout(t *testing.T) {
+	config := testConfig(t)
+
+	// split between the broker's group names, in pool ID order
+	layout, err := ResolveLayout(lager.NewLogger("test"), fakeClient{groups: brokerGroups}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Uniform(60000, 3000, []string{"blue", "green", "red"})
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout %v, want %v", layout, want)
+	}
+
+	config.FromBroker = true
+	layout, err = ResolveLayout(lager.NewLogger("test"), fakeClient{groups: brokerGroups}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Group{
+		{Name: "blue", Ranges: []Range{{Start: 59392, Size: 1024}, {Start: 60416, Size: 1024}}},
+		{Name: "green", Ranges: []Range{{Start: 61440, Size: 1024}}},
+		{Name: "red", Ranges: []Range{{Start: 63488, Size: 1023}}},
+	}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout %v, want %v", layout, want)
+	}
+}
+
+func TestResolveLayoutChecksBrokerGroupNames(t *testing.T) {
+	config := testConfig(t)
+	config.Names = []string{"blue", "green"}
+
+	if _, err := ResolveLayout(lager.NewLogger("test"), fakeClient{groups: brokerGroups}, config); err == nil {
+		t.Error("expected a broker group missing from the port pool to be rejected")
+	}
+
+	// more groups than the broker has are fine
+	config.Names = []string{"blue", "green", "red", "spare"}
+	if _, err := ResolveLayout(lager.NewLogger("test"), fakeClient{groups: brokerGroups}, config); err != nil {
+		t.Error(err)
+	}
+
+	config.Groups = 3
+	if _, err := ResolveLayout(lager.NewLogger("test"), fakeClient{groups: brokerGroups}, config); err == nil {
+		t.Error("expected 4 names to be rejected for 3 groups")
+	}
+}
+
+func TestResolveLayoutFallsBack(t *testing.T) {
+	config := testConfig(t)
+
+	// nothing saved: the broker's built-in groups
+	layout, err := ResolveLayout(lager.NewLogger("test"), unreachable, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Uniform(60000, 3000, builtInGroupNames)
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout %v, want %v", layout, want)
+	}
+
+	saved := []Group{
+		{Name: "gold", Ranges: []Range{{Start: 50000, Size: 10}}},
+		{Name: "silver", Ranges: []Range{{Start: 50010, Size: 10}}},
+	}
+	if err := SaveState(config.StatePath, State{Layout: saved}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fromBroker := range []bool{false, true} {
+		config.FromBroker = fromBroker
+
+		layout, err := ResolveLayout(lager.NewLogger("test"), unreachable, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(layout, saved) {
+			t.Errorf("from broker %t: layout %v, want the saved %v", fromBroker, layout, saved)
+		}
+	}
+
+	config.RequireBroker = true
+	if _, err := ResolveLayout(lager.NewLogger("test"), unreachable, config); err == nil {
+		t.Error("expected an unreachable broker to be fatal when it is required")
+	}
+
+	// names given explicitly do not need the broker
+	config.FromBroker = false
+	config.Names = []string{"a", "b"}
+	layout, err = ResolveLayout(lager.NewLogger("test"), unreachable, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := Uniform(60000, 3000, config.Names); !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout %v, want %v", layout, want)
+	}
+}
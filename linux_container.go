@@ -2,6 +2,7 @@ package linux_container
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,7 +15,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-        "net/http"
 
 	"github.com/blang/semver"
 	"code.cloudfoundry.org/garden"
@@ -22,6 +22,7 @@ import (
     	"code.cloudfoundry.org/garden-linux/logging"
    	"code.cloudfoundry.org/garden-linux/network"
     	"code.cloudfoundry.org/garden-linux/network/subnets"
+	"code.cloudfoundry.org/garden-linux/policyclient"
     	"code.cloudfoundry.org/garden-linux/process_tracker"
 	"github.com/cloudfoundry/gunk/command_runner"
 	"code.cloudfoundry.org/lager"
@@ -88,6 +89,8 @@ type LinuxContainer struct {
 	linux_backend.LinuxContainerSpec
 
 	portPool         PortPool
+	policyClient     policyclient.Client
+	endpoints        EndpointRegistrar
 	runner           command_runner.CommandRunner
 	cgroupsManager   CgroupsManager
 	quotaManager     QuotaManager
@@ -131,14 +134,22 @@ func (p *ProcessIDPool) Restore(id uint32) {
 }
 
 type PortPool interface {
-	Acquire(int) (uint32, error)
-	Remove(uint32) error
+	Acquire(group, handle string) (uint32, error)
+	RemoveFor(port uint32, handle string) error
 	Release(uint32)
+	Contains(uint32) bool
+}
+
+type EndpointRegistrar interface {
+	Register(ctx context.Context, container, space, endpoint string) error
+	Deregister(ctx context.Context, container, endpoint string) error
 }
 
 func NewLinuxContainer(
 	spec linux_backend.LinuxContainerSpec,
 	portPool PortPool,
+	policyClient policyclient.Client,
+	endpoints EndpointRegistrar,
 	runner command_runner.CommandRunner,
 	cgroupsManager CgroupsManager,
 	quotaManager QuotaManager,
@@ -154,6 +165,8 @@ func NewLinuxContainer(
 		LinuxContainerSpec: spec,
 
 		portPool:         portPool,
+		policyClient:     policyClient,
+		endpoints:        endpoints,
 		runner:           runner,
 		cgroupsManager:   cgroupsManager,
 		quotaManager:     quotaManager,
@@ -439,6 +452,10 @@ func (c *LinuxContainer) Stop(kill bool) error {
 		return err
 	}
 
+	// not in Cleanup: that also runs when garden shuts down and the
+	// container keeps running
+	c.deregisterEndpoints()
+
 	c.setState(linux_backend.StateStopped)
 
 	return nil
@@ -651,30 +668,39 @@ func (c *LinuxContainer) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser, er
 }
 
 func (c *LinuxContainer) NetIn(hostPort uint32, containerPort uint32) (uint32, uint32, error) {
-        cLog := c.logger.Session("netin")
+	requestID := policyclient.NewRequestID()
+	ctx := policyclient.WithRequestID(context.Background(), requestID)
+	cLog := c.logger.Session("netin", lager.Data{"request-id": requestID})
 
 	cLog.Debug("Natting")
+	space, _ := c.Property("network.space_id")
 	if hostPort == 0 {
-                space , _ := c.Property("network.space_id")
-		randomPort, err := c.portPool.Acquire(GetPoolID(space))
+		poolGroup, err := c.poolGroup(ctx, space)
+		if err != nil {
+			cLog.Error("failed-to-get-pool-group", err, lager.Data{"space": space})
+			return 0, 0, err
+		}
+
+		randomPort, err := c.portPool.Acquire(poolGroup, c.Handle())
 		if err != nil {
+			cLog.Error("failed-to-acquire-port", err, lager.Data{"space": space, "group": poolGroup})
 			return 0, 0, err
 		}
 		c.Resources.AddPort(randomPort)
 
 		hostPort = randomPort
+	} else if c.portPool.Contains(hostPort) && !c.holdsPort(hostPort) {
+		// an explicit port inside the pool is taken out of it too, so that it
+		// is not handed out again, and released with the container's ports
+		if err := c.portPool.RemoveFor(hostPort, c.Handle()); err != nil {
+			cLog.Error("failed-to-remove-port", err, lager.Data{"port": hostPort})
+			return 0, 0, err
+		}
+		c.Resources.AddPort(hostPort)
 	}
 	if containerPort == 0 {
 		containerPort = hostPort
 	}
-        if containerPort != 2222 {
-           info, err1 := c.Info()
-           space, err2 := c.Property("network.space_id")
-           ip := info.ExternalIP
-           if (err1 == nil &&  err2 == nil) {
-              postendpoint(space,ip,hostPort)
-           }
-        }
 	net := exec.Command(path.Join(c.ContainerPath, "net.sh"), "in")
 	net.Env = []string{
 		fmt.Sprintf("HOST_PORT=%d", hostPort),
@@ -688,17 +714,28 @@ func (c *LinuxContainer) NetIn(hostPort uint32, containerPort uint32) (uint32, u
 	}
 
 	c.netInsMutex.Lock()
-	defer c.netInsMutex.Unlock()
-
 	c.NetIns = append(c.NetIns, linux_backend.NetInSpec{hostPort, containerPort})
+	c.netInsMutex.Unlock()
+
+	// only once the mapping exists; it stays registered until the container
+	// is stopped or destroyed
+	if containerPort != 2222 && space != "" {
+		c.registerEndpoint(ctx, cLog, space, hostPort)
+	}
 
 	return hostPort, containerPort, nil
 }
 
-func postendpoint(space string, ip string, port uint32) {
-	b :=  "{\"space\" : \"" + space + "\"," + "\"endpoint\" : \"" + ip + ":" + strconv.FormatUint(uint64(port), 10) + "\"}"
-	response, _ := http.Post( GetUrl(),"application/json",bytes.NewBufferString(b))
-	defer response.Body.Close()
+// holdsPort reports whether the port is already one of the container's, as
+// the ports it acquired are when it is restored.
+func (c *LinuxContainer) holdsPort(port uint32) bool {
+	for _, held := range c.Resources.Ports {
+		if held == port {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (c *LinuxContainer) NetOut(r garden.NetOutRule) error {
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -24,6 +28,7 @@ import (
 	"code.cloudfoundry.org/cflager"
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/garden-linux/container_repository"
+	"code.cloudfoundry.org/garden-linux/endpoint_queue"
 	"code.cloudfoundry.org/garden-linux/linux_backend"
 	"code.cloudfoundry.org/garden-linux/linux_container"
 	"code.cloudfoundry.org/garden-linux/linux_container/bandwidth_manager"
@@ -36,6 +41,8 @@ import (
 	"code.cloudfoundry.org/garden-linux/network/iptables"
 	"code.cloudfoundry.org/garden-linux/network/subnets"
 	"code.cloudfoundry.org/garden-linux/pkg/vars"
+	"code.cloudfoundry.org/garden-linux/policy_reconciler"
+	"code.cloudfoundry.org/garden-linux/policyclient"
 	"code.cloudfoundry.org/garden-linux/port_pool"
 	"code.cloudfoundry.org/garden-linux/process_tracker"
 	"code.cloudfoundry.org/garden-linux/resource_pool"
@@ -99,11 +106,95 @@ var stateDirPath = flag.String(
 )
 
 var policyBrokerUrl = flag.String(
-        "policyURL",
-        "",
-        "ip address of the policy broker",
+	"policyURL",
+	"",
+	"URL of the policy broker (a bare host defaults to http on port "+policyclient.DefaultPort+")",
+)
+
+var policyCACert = flag.String(
+	"policyCACert",
+	"",
+	"PEM file of CA certificates to verify the policy broker with (implies https)",
+)
+
+var policyClientCert = flag.String(
+	"policyClientCert",
+	"",
+	"PEM client certificate presented to the policy broker",
+)
+
+var policyClientKey = flag.String(
+	"policyClientKey",
+	"",
+	"PEM private key of -policyClientCert",
+)
+
+var policyToken = flag.String(
+	"policyToken",
+	"",
+	"bearer token sent to the policy broker",
+)
+
+var policyTokenFile = flag.String(
+	"policyTokenFile",
+	"",
+	"file containing the bearer token sent to the policy broker, instead of -policyToken",
+)
+
+var policyTimeout = flag.Duration(
+	"policyTimeout",
+	5*time.Second,
+	"timeout of a single request to the policy broker",
+)
+
+var policyFailureMode = flag.String(
+	"policyFailureMode",
+	string(policyclient.FailClosed),
+	"what NetIn does when the policy broker is unreachable: fail-closed returns an error, fail-open uses -policyDefaultGroup",
+)
+
+var policyDefaultGroup = flag.String(
+	"policyDefaultGroup",
+	"",
+	"port pool group used in fail-open mode (defaults to the first group)",
+)
+
+var policyRetries = flag.Int(
+	"policyRetries",
+	3,
+	"number of retries of a failed policy broker request",
+)
+
+var policyRetryBackoff = flag.Duration(
+	"policyRetryBackoff",
+	100*time.Millisecond,
+	"initial backoff between policy broker retries, doubled on every retry",
+)
+
+var policyBreakerErrors = flag.Int(
+	"policyBreakerErrors",
+	5,
+	"consecutive policy broker failures after which requests are short-circuited",
 )
- 
+
+var policyBreakerTimeout = flag.Duration(
+	"policyBreakerTimeout",
+	30*time.Second,
+	"time after which a short-circuited policy broker is tried again",
+)
+
+var policyReconcileInterval = flag.Duration(
+	"policyReconcileInterval",
+	5*time.Minute,
+	"interval at which all mapped ports are reconciled with the policy broker (0 disables)",
+)
+
+var policyReconcileDryRun = flag.Bool(
+	"policyReconcileDryRun",
+	false,
+	"only report endpoints the policy broker would add or remove when reconciling",
+)
+
 var depotPath = flag.String(
 	"depot",
 	"",
@@ -140,6 +231,36 @@ var portPoolSize = flag.Uint(
 	"size of port pool used for mapped container ports",
 )
 
+var portPoolGroups = flag.Uint(
+	"portPoolGroups",
+	3,
+	"number of equal groups the port pool is split into, one per group name, the last taking any remainder (0 takes as many as there are names)",
+)
+
+var portPoolGroupNames = flag.String(
+	"portPoolGroupNames",
+	"",
+	"comma-separated names of the equal port pool groups, matching the policy broker's group names (defaults to the broker's groups in pool ID order)",
+)
+
+var portPoolLayout = flag.String(
+	"portPoolLayout",
+	"",
+	"JSON file listing the port pool groups, each with a policy broker group name and ranges, e.g. [{\"name\":\"blue\",\"ranges\":[{\"start\":59392,\"size\":2048}]}]; replaces -portPoolStart, -portPoolSize, -portPoolGroups and -portPoolGroupNames",
+)
+
+var portPoolLayoutFromBroker = flag.Bool(
+	"portPoolLayoutFromBroker",
+	false,
+	"take the port pool groups and their ranges from the policy broker's groups at startup",
+)
+
+var portPoolRequireBroker = flag.Bool(
+	"portPoolRequireBroker",
+	false,
+	"refuse to start when the port pool groups have to come from the policy broker and it is unreachable, instead of keeping the saved layout",
+)
+
 var networkPool = flag.String("networkPool",
 	DefaultNetworkPool,
 	"Pool of dynamically allocated container subnets")
@@ -295,19 +416,127 @@ func main() {
 	if err != nil {
 		logger.Fatal("failed-to-create-subnet-pool", err)
 	}
-        
-        linux_container.SetUrl(*policyBrokerUrl)
 
-	portPoolState, err := port_pool.LoadState(path.Join(*stateDirPath, "port_pool.json"))
+	failureMode, err := policyclient.ParseFailureMode(*policyFailureMode)
 	if err != nil {
-		logger.Error("failed-to-parse-pool-state", err)
+		logger.Fatal("invalid-policy-failure-mode", err)
+	}
+
+	if *policyBreakerErrors < 1 {
+		println("-policyBreakerErrors must be at least 1")
+		println()
+		flag.Usage()
+		return
 	}
 
+	if *policyRetries < 0 {
+		println("-policyRetries must not be negative")
+		println()
+		flag.Usage()
+		return
+	}
+
+	token := *policyToken
+	if *policyTokenFile != "" {
+		contents, err := ioutil.ReadFile(*policyTokenFile)
+		if err != nil {
+			logger.Fatal("failed-to-read-policy-token-file", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	policyClient, err := policyclient.New(policyclient.Config{
+		URL:        *policyBrokerUrl,
+		Timeout:    *policyTimeout,
+		CACertFile: *policyCACert,
+		CertFile:   *policyClientCert,
+		KeyFile:    *policyClientKey,
+		Token:      token,
+	}, logger)
+	if err != nil {
+		logger.Fatal("failed-to-create-policy-client", err)
+	}
+
+	resilience := policyclient.ResilienceConfig{
+		FailureMode:    failureMode,
+		DefaultGroup:   *policyDefaultGroup,
+		Retries:        *policyRetries,
+		RetryBackoff:   *policyRetryBackoff,
+		BreakerErrors:  *policyBreakerErrors,
+		BreakerTimeout: *policyBreakerTimeout,
+	}
+
+	portPoolStatePath := path.Join(*stateDirPath, "port_pool.json")
+
 	// TODO: use /proc/sys/net/ipv4/ip_local_port_range by default (end + 1)
-	portPool, err := port_pool.New(uint32(*portPoolStart), uint32(*portPoolSize),3, portPoolState)
+	var portPoolNames []string
+	if *portPoolGroupNames != "" {
+		portPoolNames = strings.Split(*portPoolGroupNames, ",")
+	}
+
+	poolLayout, err := port_pool.ResolveLayout(logger, policyclient.NewResilient(policyClient, resilience, logger), port_pool.LayoutConfig{
+		FromBroker:    *portPoolLayoutFromBroker,
+		File:          *portPoolLayout,
+		Start:         uint32(*portPoolStart),
+		Size:          uint32(*portPoolSize),
+		Names:         portPoolNames,
+		Groups:        *portPoolGroups,
+		RequireBroker: *portPoolRequireBroker,
+		StatePath:     portPoolStatePath,
+	})
+	if err != nil {
+		logger.Fatal("invalid-port-pool-layout", err)
+	}
+
+	defaultGroup := *policyDefaultGroup
+	if defaultGroup == "" {
+		defaultGroup = poolLayout[0].Name
+	}
+
+	if !hasGroup(poolLayout, defaultGroup) {
+		logger.Fatal("invalid-port-pool-layout", fmt.Errorf("-policyDefaultGroup %s is not one of the port pool groups", defaultGroup))
+	}
+
+	resilience.DefaultGroup = defaultGroup
+	policyClient = policyclient.NewResilient(policyClient, resilience, logger)
+
+	checkPolicyBroker(logger, policyClient, *policyTimeout)
+
+	endpointQueue, err := endpoint_queue.New(
+		path.Join(*stateDirPath, "policy_endpoint_queue.json"),
+		policyClient,
+		time.Second,
+		time.Minute,
+		logger,
+	)
+	if err != nil {
+		logger.Fatal("failed-to-load-endpoint-queue", err)
+	}
+
+	endpointQueue.Start()
+
+	portPoolState, err := port_pool.LoadState(portPoolStatePath, poolLayout)
+	if _, ok := err.(port_pool.UnsupportedStateVersionError); ok {
+		logger.Fatal("failed-to-parse-pool-state", err)
+	}
+	if err != nil {
+		logger.Error("failed-to-parse-pool-state", err)
+	}
+
+	portPool, err := port_pool.New(poolLayout, portPoolState, portPoolStatePath, logger)
 	if err != nil {
 		logger.Fatal("invalid pool range", err)
 	}
+
+	for _, conflict := range portPool.Reconcile(restoredPorts(logger, *snapshotsPath, portPool)) {
+		logger.Error("port-pool-conflict", conflict, lager.Data{
+			"port":   conflict.Port,
+			"handle": conflict.Handle,
+			"owner":  conflict.Owner,
+			"reason": conflict.Reason,
+		})
+	}
+
 	useKernelLogging := true
 	switch *iptablesLogMethod {
 	case "nflog":
@@ -478,6 +707,8 @@ func main() {
 		runner:           runner,
 		log:              logger,
 		portPool:         portPool,
+		policyClient:     policyClient,
+		endpointQueue:    endpointQueue,
 		ipTablesMgr:      ipTablesMgr,
 		sysconfig:        config,
 		quotaManager:     quotaManager,
@@ -514,7 +745,11 @@ func main() {
 
 	systemInfo := sysinfo.NewProvider(*depotPath)
 
-	backend := linux_backend.New(logger, pool, repo, injector, systemInfo, layercake.GraphPath(*graphRoot), *snapshotsPath, int(*maxContainers))
+	backend := linux_backend.New(logger, &deregisteringResourcePool{
+		ResourcePool: pool,
+		endpoints:    endpointQueue,
+		logger:       logger.Session("resource-pool"),
+	}, repo, injector, systemInfo, layercake.GraphPath(*graphRoot), *snapshotsPath, int(*maxContainers))
 
 	err = backend.Setup()
 	if err != nil {
@@ -530,20 +765,30 @@ func main() {
 		logger.Fatal("failed-to-start-server", err)
 	}
 
+	// starting the server restored the containers
+	portPool.FinishRestore()
+
 	clock := clock.NewClock()
 	metronNotifier := metrics.NewPeriodicMetronNotifier(logger, metricsProvider, *metricsEmissionInterval, clock)
 	metronNotifier.Start()
 
+	var policyReconciler *policy_reconciler.Reconciler
+	if *policyReconcileInterval > 0 {
+		policyReconciler = policy_reconciler.New(backend, policyClient, parsedExternalIP, *policyReconcileInterval, *policyReconcileDryRun, logger)
+		policyReconciler.Start()
+	}
+
 	signals := make(chan os.Signal, 1)
 
 	go func() {
 		<-signals
 
-		portPoolState = portPool.RefreshState()
-		port_pool.SaveState(path.Join(*stateDirPath, "port_pool.json"), portPoolState)
-
 		gardenServer.Stop()
 		metronNotifier.Stop()
+		if policyReconciler != nil {
+			policyReconciler.Stop()
+		}
+		endpointQueue.Stop()
 
 		os.Exit(0)
 	}()
@@ -558,6 +803,33 @@ func main() {
 	select {}
 }
 
+// checkPolicyBroker logs whether the policy broker is ready, so that a broken
+// broker shows up at startup rather than on the first NetIn. Garden starts
+// either way.
+func checkPolicyBroker(logger lager.Logger, client policyclient.Client, timeout time.Duration) {
+	logger = logger.Session("check-policy-broker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	readiness, err := client.Ready(ctx)
+	if err != nil {
+		logger.Error("not-ready", err, lager.Data{"checks": readiness.Checks})
+		return
+	}
+
+	logger.Info("ready", lager.Data{"checks": readiness.Checks})
+}
+
+func hasGroup(layout []port_pool.Group, name string) bool {
+	for _, group := range layout {
+		if group.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func missing(flagName string) {
 	println("missing " + flagName)
 	println()
@@ -584,11 +856,109 @@ type provider struct {
 	runner           command_runner.CommandRunner
 	log              lager.Logger
 	portPool         *port_pool.PortPool
+	policyClient     policyclient.Client
+	endpointQueue    *endpoint_queue.Queue
 	ipTablesMgr      linux_container.IPTablesManager
 	quotaManager     linux_container.QuotaManager
 	sysconfig        sysconfig.Config
 }
 
+// deregisteringResourcePool removes a destroyed container's endpoints from
+// the policy broker. Destroying a container releases its resources without
+// going through LinuxContainer.Stop.
+type deregisteringResourcePool struct {
+	linux_backend.ResourcePool
+	endpoints *endpoint_queue.Queue
+	logger    lager.Logger
+}
+
+func (p *deregisteringResourcePool) Release(container linux_backend.LinuxContainerSpec) error {
+	if err := p.ResourcePool.Release(container); err != nil {
+		return err
+	}
+
+	// the same endpoints as LinuxContainer.Stop deregisters
+	if container.Properties["network.space_id"] == "" {
+		return nil
+	}
+
+	ctx := policyclient.WithRequestID(context.Background(), policyclient.NewRequestID())
+	for _, in := range container.NetIns {
+		if in.ContainerPort == 2222 {
+			continue
+		}
+
+		endpoint := net.JoinHostPort(container.Resources.ExternalIP.String(), strconv.FormatUint(uint64(in.HostPort), 10))
+		if err := p.endpoints.Deregister(ctx, container.Handle, endpoint); err != nil {
+			p.logger.Error("failed-to-queue-endpoint-deregistration", err, lager.Data{"handle": container.Handle, "endpoint": endpoint})
+		}
+	}
+
+	return nil
+}
+
+// restoredPorts lists the host ports of the containers the backend is about
+// to restore from their snapshots: the ports they acquired, and the ports
+// they mapped explicitly that fall inside the pool, which restoring their
+// NetIns adds to the container's ports so that destroying it releases them.
+// Snapshots that cannot be read are skipped, as the backend cannot restore
+// them either.
+func restoredPorts(logger lager.Logger, snapshotsPath string, portPool *port_pool.PortPool) []port_pool.Allocation {
+	logger = logger.Session("restored-ports")
+
+	if snapshotsPath == "" {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(snapshotsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("failed-to-read-snapshots", err)
+		}
+		return nil
+	}
+
+	var allocations []port_pool.Allocation
+	for _, entry := range entries {
+		snapshotPath := path.Join(snapshotsPath, entry.Name())
+
+		snapshot, err := readSnapshot(snapshotPath)
+		if err != nil {
+			logger.Error("failed-to-read-snapshot", err, lager.Data{"snapshot": snapshotPath})
+			continue
+		}
+
+		ports := make(map[uint32]bool)
+		for _, port := range snapshot.Resources.Ports {
+			ports[port] = true
+		}
+		for _, netIn := range snapshot.NetIns {
+			if portPool.Contains(netIn.HostPort) {
+				ports[netIn.HostPort] = true
+			}
+		}
+
+		for port := range ports {
+			allocations = append(allocations, port_pool.Allocation{Port: port, Handle: snapshot.Handle})
+		}
+	}
+
+	return allocations
+}
+
+func readSnapshot(snapshotPath string) (linux_container.ContainerSnapshot, error) {
+	var snapshot linux_container.ContainerSnapshot
+
+	snapshotFile, err := os.Open(snapshotPath)
+	if err != nil {
+		return snapshot, err
+	}
+	defer snapshotFile.Close()
+
+	err = json.NewDecoder(snapshotFile).Decode(&snapshot)
+	return snapshot, err
+}
+
 func (p *provider) ProvideFilter(containerId string) network.Filter {
 	return network.NewFilter(iptables.NewLoggingChain(p.chainPrefix+containerId, p.useKernelLogging, p.runner, p.log.Session(containerId).Session("filter")))
 }
@@ -607,6 +977,8 @@ func (p *provider) ProvideContainer(spec linux_backend.LinuxContainerSpec) linux
 	return linux_container.NewLinuxContainer(
 		spec,
 		p.portPool,
+		p.policyClient,
+		p.endpointQueue,
 		p.runner,
 		cgroupsManager,
 		p.quotaManager,
@@ -1,28 +1,63 @@
 package linux_container
 
-
 import (
-	"net/http"
+	"context"
+	"net"
 	"strconv"
-	"bytes"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
 )
 
-var Url string
+// poolGroup asks the policy broker which port pool group the space's ports
+// come from.
+func (c *LinuxContainer) poolGroup(ctx context.Context, space string) (string, error) {
+	policy, err := c.policyClient.SpacePolicy(ctx, space)
+	if err != nil {
+		return "", err
+	}
+
+	return policy.Group, nil
+}
+
+// registerEndpoint queues the mapped port for registration with the policy
+// broker; delivery happens in the background. Failing to queue is logged,
+// the mapping itself has already succeeded.
+func (c *LinuxContainer) registerEndpoint(ctx context.Context, logger lager.Logger, space string, hostPort uint32) {
+	endpoint := c.endpoint(hostPort)
 
-func SetUrl(url string) {
-	Url = url
+	if err := c.endpoints.Register(ctx, c.Handle(), space, endpoint); err != nil {
+		logger.Error("failed-to-queue-endpoint-registration", err, lager.Data{"space": space, "endpoint": endpoint})
+	}
 }
 
-func GetUrl() string {
-    	
-    return "http://" + Url +":8000/spacegroup"
+// deregisterEndpoints queues the removal of every endpoint registered by
+// NetIn.
+func (c *LinuxContainer) deregisterEndpoints() {
+	space, _ := c.Property("network.space_id")
+	if space == "" {
+		return
+	}
+
+	requestID := policyclient.NewRequestID()
+	ctx := policyclient.WithRequestID(context.Background(), requestID)
+	logger := c.logger.Session("deregister-endpoints", lager.Data{"request-id": requestID})
+
+	c.netInsMutex.RLock()
+	defer c.netInsMutex.RUnlock()
+
+	for _, in := range c.NetIns {
+		if in.ContainerPort == 2222 {
+			continue
+		}
+
+		endpoint := c.endpoint(in.HostPort)
+		if err := c.endpoints.Deregister(ctx, c.Handle(), endpoint); err != nil {
+			logger.Error("failed-to-queue-endpoint-deregistration", err, lager.Data{"endpoint": endpoint})
+		}
+	}
 }
 
-func GetPoolID(space string) int {
-	response, _ := http.Get(GetUrl()+"?space="+space)
-	defer response.Body.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(response.Body)
-        result, _ := strconv.Atoi(buf.String())
-	return result
+func (c *LinuxContainer) endpoint(hostPort uint32) string {
+	return net.JoinHostPort(c.Resources.ExternalIP.String(), strconv.FormatUint(uint64(hostPort), 10))
 }
@@ -0,0 +1,142 @@
+package policy_reconciler
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+type ContainerLister interface {
+	Containers(garden.Properties) ([]garden.Container, error)
+}
+
+// Reconciler periodically sends the broker every endpoint mapped by the
+// running containers, so that registrations the broker missed or kept after
+// a container went away are corrected.
+type Reconciler struct {
+	containers ContainerLister
+	client     policyclient.Client
+	externalIP net.IP
+	interval   time.Duration
+	dryRun     bool
+	logger     lager.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(containers ContainerLister, client policyclient.Client, externalIP net.IP, interval time.Duration, dryRun bool, logger lager.Logger) *Reconciler {
+	return &Reconciler{
+		containers: containers,
+		client:     client,
+		externalIP: externalIP,
+		interval:   interval,
+		dryRun:     dryRun,
+		logger:     logger.Session("policy-reconciler"),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (r *Reconciler) Start() {
+	go r.run()
+}
+
+func (r *Reconciler) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Reconciler) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.Reconcile()
+		}
+	}
+}
+
+// Reconcile sends one full set of endpoints. Errors are logged; the next
+// tick tries again.
+func (r *Reconciler) Reconcile() (policyclient.ReconcileResult, error) {
+	requestID := policyclient.NewRequestID()
+	logger := r.logger.Session("reconcile", lager.Data{"dry-run": r.dryRun, "request-id": requestID})
+
+	endpoints, err := r.endpoints()
+	if err != nil {
+		logger.Error("failed-to-list-endpoints", err)
+		return policyclient.ReconcileResult{}, err
+	}
+
+	result, err := r.client.Reconcile(policyclient.WithRequestID(context.Background(), requestID), policyclient.ReconcileRequest{
+		Host:      r.externalIP.String(),
+		Endpoints: endpoints,
+		DryRun:    r.dryRun,
+	})
+	if err != nil {
+		logger.Error("failed", err)
+		return result, err
+	}
+
+	data := lager.Data{"endpoints": len(endpoints), "added": result.Added, "removed": result.Removed}
+	if len(result.Added) == 0 && len(result.Removed) == 0 {
+		logger.Debug("in-sync", data)
+	} else if r.dryRun {
+		logger.Info("drift-detected", data)
+	} else {
+		logger.Info("drift-corrected", data)
+	}
+
+	return result, nil
+}
+
+// endpoints mirrors what NetIn registers: every mapped port of an active
+// container with a space, except ssh.
+func (r *Reconciler) endpoints() ([]policyclient.SpaceGroup, error) {
+	containers, err := r.containers.Containers(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []policyclient.SpaceGroup{}
+	for _, container := range containers {
+		// skipping the container would make the broker drop its endpoints
+		info, err := container.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		space := info.Properties["network.space_id"]
+		if space == "" || info.State != "active" {
+			continue
+		}
+
+		for _, mapping := range info.MappedPorts {
+			if mapping.ContainerPort == 2222 {
+				continue
+			}
+
+			endpoints = append(endpoints, policyclient.SpaceGroup{
+				Space:    space,
+				Endpoint: net.JoinHostPort(r.externalIP.String(), strconv.FormatUint(uint64(mapping.HostPort), 10)),
+			})
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Endpoint < endpoints[j].Endpoint })
+
+	return endpoints, nil
+}
@@ -0,0 +1,89 @@
+package policy_reconciler
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+type fakeContainer struct {
+	garden.Container
+	info garden.ContainerInfo
+}
+
+func (c fakeContainer) Info() (garden.ContainerInfo, error) {
+	return c.info, nil
+}
+
+type fakeLister []garden.Container
+
+func (l fakeLister) Containers(garden.Properties) ([]garden.Container, error) {
+	return l, nil
+}
+
+// fakeClient records the reconcile requests it gets.
+type fakeClient struct {
+	policyclient.Client
+	requests []policyclient.ReconcileRequest
+}
+
+func (c *fakeClient) Reconcile(ctx context.Context, req policyclient.ReconcileRequest) (policyclient.ReconcileResult, error) {
+	c.requests = append(c.requests, req)
+	return policyclient.ReconcileResult{DryRun: req.DryRun}, nil
+}
+
+func TestReconcileSendsEveryRegisteredEndpoint(t *testing.T) {
+	containers := fakeLister{
+		fakeContainer{info: garden.ContainerInfo{
+			State:      "active",
+			Properties: garden.Properties{"network.space_id": "space-a"},
+			MappedPorts: []garden.PortMapping{
+				{HostPort: 60001, ContainerPort: 8080},
+				{HostPort: 60000, ContainerPort: 2222},
+			},
+		}},
+		fakeContainer{info: garden.ContainerInfo{
+			State:       "active",
+			Properties:  garden.Properties{"network.space_id": "space-b"},
+			MappedPorts: []garden.PortMapping{{HostPort: 60000, ContainerPort: 8080}},
+		}},
+		fakeContainer{info: garden.ContainerInfo{
+			State:       "stopped",
+			Properties:  garden.Properties{"network.space_id": "space-c"},
+			MappedPorts: []garden.PortMapping{{HostPort: 60002, ContainerPort: 8080}},
+		}},
+		fakeContainer{info: garden.ContainerInfo{
+			State:       "active",
+			MappedPorts: []garden.PortMapping{{HostPort: 60003, ContainerPort: 8080}},
+		}},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		client := &fakeClient{}
+		reconciler := New(containers, client, net.ParseIP("10.0.0.1"), time.Minute, dryRun, lager.NewLogger("test"))
+
+		if _, err := reconciler.Reconcile(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the full set, so that the broker drops what is not in it: no ssh
+		// ports, stopped containers or containers without a space
+		want := []policyclient.ReconcileRequest{{
+			Host: "10.0.0.1",
+			Endpoints: []policyclient.SpaceGroup{
+				{Space: "space-b", Endpoint: "10.0.0.1:60000"},
+				{Space: "space-a", Endpoint: "10.0.0.1:60001"},
+			},
+			DryRun: dryRun,
+		}}
+		if !reflect.DeepEqual(client.requests, want) {
+			t.Errorf("requests %+v, want %+v", client.requests, want)
+		}
+	}
+}
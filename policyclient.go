@@ -0,0 +1,312 @@
+package policyclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const DefaultPort = "8000"
+
+// RequestIDHeader carries the request ID to the broker, which logs it with
+// everything it does for the request.
+const RequestIDHeader = "X-Request-Id"
+
+type Client interface {
+	SpacePolicy(ctx context.Context, space string) (SpacePolicy, error)
+	Groups(ctx context.Context) ([]Group, error)
+	RegisterEndpoint(ctx context.Context, space string, endpoint string) (Endpoint, error)
+	DeregisterEndpoint(ctx context.Context, endpoint string) error
+	Reconcile(ctx context.Context, req ReconcileRequest) (ReconcileResult, error)
+	Ready(ctx context.Context) (Readiness, error)
+}
+
+type Config struct {
+	// URL of the broker. A bare host is accepted and defaults to http on
+	// DefaultPort, or https if any TLS file is set.
+	URL     string
+	Timeout time.Duration
+
+	// CACertFile verifies the broker's certificate; CertFile and KeyFile are
+	// presented as client certificate.
+	CACertFile string
+	CertFile   string
+	KeyFile    string
+
+	// Token is sent as bearer token.
+	Token string
+}
+
+func (config Config) tlsEnabled() bool {
+	return config.CACertFile != "" || config.CertFile != "" || config.KeyFile != ""
+}
+
+// Error is returned for any non-2xx response from the broker.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (err Error) Error() string {
+	return fmt.Sprintf("policy broker: %d: %s", err.StatusCode, err.Message)
+}
+
+type client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+	logger     lager.Logger
+}
+
+func New(config Config, logger lager.Logger) (Client, error) {
+	raw := config.URL
+	if config.tlsEnabled() && raw != "" && !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	baseURL, err := ParseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: config.Timeout}
+	if config.tlsEnabled() {
+		if baseURL.Scheme != "https" {
+			return nil, fmt.Errorf("policyclient: TLS configured but broker URL %s is not https", baseURL)
+		}
+
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	return &client{
+		baseURL:    baseURL,
+		httpClient: httpClient,
+		token:      config.Token,
+		logger:     logger.Session("policy-broker-client"),
+	}, nil
+}
+
+func newTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("policyclient: reading CA file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("policyclient: no certificates found in %s", config.CACertFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("policyclient: client certificate and key must be given together")
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("policyclient: loading client key pair: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// ParseURL accepts "host", "host:port" or a full URL.
+func ParseURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("policyclient: empty broker URL")
+	}
+
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("policyclient: invalid broker URL: %s", err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("policyclient: invalid broker URL %q: missing host", raw)
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	return u, nil
+}
+
+func (c *client) SpacePolicy(ctx context.Context, space string) (SpacePolicy, error) {
+	var policy SpacePolicy
+	err := c.do(ctx, "GET", "/v1/policy", url.Values{"space": {space}}, nil, &policy)
+	return policy, err
+}
+
+func (c *client) Groups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := c.do(ctx, "GET", "/v1/groups", nil, nil, &groups)
+	return groups, err
+}
+
+func (c *client) RegisterEndpoint(ctx context.Context, space string, endpoint string) (Endpoint, error) {
+	var registered Endpoint
+	err := c.do(ctx, "POST", "/v1/endpoints", nil, SpaceGroup{Space: space, Endpoint: endpoint}, &registered)
+	return registered, err
+}
+
+// DeregisterEndpoint succeeds if the broker does not know the endpoint.
+func (c *client) DeregisterEndpoint(ctx context.Context, endpoint string) error {
+	err := c.do(ctx, "DELETE", "/v1/endpoints/"+url.PathEscape(endpoint), nil, nil, nil)
+	if brokerErr, ok := err.(Error); ok && brokerErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (c *client) Reconcile(ctx context.Context, req ReconcileRequest) (ReconcileResult, error) {
+	var result ReconcileResult
+	err := c.do(ctx, "POST", "/v1/reconcile", nil, req, &result)
+	return result, err
+}
+
+// Ready returns the failing checks along with the error when the broker is
+// up but not ready.
+func (c *client) Ready(ctx context.Context) (Readiness, error) {
+	var readiness Readiness
+	err := c.do(ctx, "GET", "/readyz", nil, nil, &readiness)
+	if brokerErr, ok := err.(Error); ok && brokerErr.StatusCode == http.StatusServiceUnavailable {
+		json.Unmarshal([]byte(brokerErr.Message), &readiness)
+	}
+
+	return readiness, err
+}
+
+func (c *client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	u := *c.baseURL
+	u.Path = c.baseURL.Path + path
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+
+	requestID := RequestID(ctx)
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RequestIDHeader, requestID)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	data := lager.Data{"request-id": requestID, "method": method, "path": path}
+	c.logger.Debug("requesting", data)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("policy broker: %s %s: %s", method, path, err)
+		c.logger.Error("request-failed", err, data)
+		return err
+	}
+	defer resp.Body.Close()
+
+	data["status"] = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		contents, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		var errResponse ErrorResponse
+		if json.Unmarshal(contents, &errResponse) != nil || errResponse.Error == "" {
+			errResponse.Error = strings.TrimSpace(string(contents))
+		}
+
+		err := Error{StatusCode: resp.StatusCode, Message: errResponse.Error}
+		c.logger.Error("request-failed", err, data)
+		return err
+	}
+
+	c.logger.Debug("requested", data)
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("policy broker: %s %s: decoding response: %s", method, path, err)
+	}
+
+	return nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID makes requests made with ctx carry id, so that the broker's
+// logs can be matched with the caller's. Without one every request gets a new
+// ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %s", err)) // should never happen..
+	}
+
+	return hex.EncodeToString(buf)
+}
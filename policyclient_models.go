@@ -0,0 +1,103 @@
+package policyclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SpaceGroup registers Endpoint (externalIP:hostPort) for Space.
+type SpaceGroup struct {
+	Space    string `json:"space"`
+	Endpoint string `json:"endpoint"`
+}
+
+// SpacePolicy is a space and the group it is classified into.
+type SpacePolicy struct {
+	Guid    string `json:"guid"`
+	Name    string `json:"name,omitempty"`
+	OrgName string `json:"org_name,omitempty"`
+	Group   string `json:"group"`
+	PoolID  int    `json:"pool_id"`
+}
+
+// Group is a policy group. The policy tag and the endpoint group tag are the
+// same name, which is also the name of the garden port pool group the space's
+// ports come from. PoolID orders the groups.
+type Group struct {
+	Name       string   `json:"name"`
+	PoolID     int      `json:"pool_id"`
+	PortRanges []string `json:"port_ranges"`
+}
+
+// ParsePortRange parses one of a group's "start/size" port ranges. The range
+// must be non-empty and lie within the 16-bit port space.
+func ParsePortRange(portRange string) (uint32, uint32, error) {
+	parts := strings.Split(portRange, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q: expected start/size", portRange)
+	}
+
+	start, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s", portRange, err)
+	}
+
+	size, err := strconv.ParseUint(parts[1], 10, 17)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s", portRange, err)
+	}
+
+	if size == 0 || start+size > 65536 {
+		return 0, 0, fmt.Errorf("invalid port range %q: out of bounds", portRange)
+	}
+
+	return uint32(start), uint32(size), nil
+}
+
+// Endpoint is an externalIP:hostPort registered by garden for a space.
+type Endpoint struct {
+	Space   string `json:"space"`
+	Address string `json:"endpoint"`
+	Group   string `json:"group"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// ReconcileRequest is the full set of endpoints garden has mapped on Host.
+// The broker removes its other endpoints on that host and adds the missing
+// ones; with DryRun it only reports what it would change.
+type ReconcileRequest struct {
+	Host      string       `json:"host"`
+	Endpoints []SpaceGroup `json:"endpoints"`
+	DryRun    bool         `json:"dry_run"`
+}
+
+type ReconcileResult struct {
+	Added   []Endpoint `json:"added"`
+	Removed []Endpoint `json:"removed"`
+	DryRun  bool       `json:"dry_run"`
+}
+
+const (
+	StatusReady    = "ready"
+	StatusNotReady = "not ready"
+)
+
+// Readiness is the broker's answer to /readyz, with the result of every check
+// by name.
+type Readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+func (r Readiness) Ready() bool {
+	return r.Status == StatusReady
+}
+
+type Check struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
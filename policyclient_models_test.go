@@ -0,0 +1,32 @@
+package policyclient
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		portRange   string
+		start, size uint32
+		valid       bool
+	}{
+		{"60000/1666", 60000, 1666, true},
+		{"0/65536", 0, 65536, true},
+		{"65535/1", 65535, 1, true},
+		{"65535/2", 0, 0, false},
+		{"60000/0", 0, 0, false},
+		{"65536/1", 0, 0, false},
+		{"1/65536", 0, 0, false},
+		{"60000", 0, 0, false},
+		{"60000/10/2", 0, 0, false},
+		{"-1/10", 0, 0, false},
+		{"a/10", 0, 0, false},
+	} {
+		start, size, err := ParsePortRange(tc.portRange)
+		if tc.valid != (err == nil) {
+			t.Errorf("%q: unexpected error %v", tc.portRange, err)
+			continue
+		}
+		if start != tc.start || size != tc.size {
+			t.Errorf("%q: got %d/%d, want %d/%d", tc.portRange, start, size, tc.start, tc.size)
+		}
+	}
+}
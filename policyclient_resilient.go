@@ -0,0 +1,203 @@
+package policyclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/eapache/go-resiliency/breaker"
+	"github.com/eapache/go-resiliency/retrier"
+)
+
+type FailureMode string
+
+const (
+	// FailClosed returns the broker error to the caller.
+	FailClosed FailureMode = "fail-closed"
+	// FailOpen answers SpacePolicy with the default pool instead.
+	FailOpen FailureMode = "fail-open"
+)
+
+func ParseFailureMode(mode string) (FailureMode, error) {
+	switch FailureMode(mode) {
+	case FailClosed, FailOpen:
+		return FailureMode(mode), nil
+	}
+
+	return "", fmt.Errorf("policyclient: unknown failure mode %q, expected %s or %s", mode, FailClosed, FailOpen)
+}
+
+type ResilienceConfig struct {
+	FailureMode  FailureMode
+	DefaultGroup string
+
+	Retries      int
+	RetryBackoff time.Duration
+
+	// the breaker opens after BreakerErrors consecutive failures and lets a
+	// request through again after BreakerTimeout
+	BreakerErrors  int
+	BreakerTimeout time.Duration
+}
+
+// resilientClient retries requests that failed for reasons other than a 4xx
+// from the broker, and stops calling a broker that keeps failing. Only
+// SpacePolicy honours the failure mode; endpoint (de)registration errors are
+// always returned. It is used concurrently by NetIn, the endpoint queue and
+// the reconciler, so the backoff schedule is only ever read.
+type resilientClient struct {
+	client  Client
+	config  ResilienceConfig
+	backoff []time.Duration
+	breaker *breaker.Breaker
+	logger  lager.Logger
+}
+
+func NewResilient(client Client, config ResilienceConfig, logger lager.Logger) Client {
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+
+	return &resilientClient{
+		client:  client,
+		config:  config,
+		backoff: retrier.ExponentialBackoff(config.Retries, config.RetryBackoff),
+		breaker: breaker.New(config.BreakerErrors, 1, config.BreakerTimeout),
+		logger:  logger.Session("policy-client"),
+	}
+}
+
+func (c *resilientClient) SpacePolicy(ctx context.Context, space string) (SpacePolicy, error) {
+	var policy SpacePolicy
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		policy, err = c.client.SpacePolicy(ctx, space)
+		return err
+	})
+	if err == nil {
+		return policy, nil
+	}
+
+	if c.config.FailureMode != FailOpen || isClientError(err) {
+		metrics.IncrementCounter("PolicyBrokerFailClosed")
+		c.logger.Error("failing-closed", err, lager.Data{"space": space, "request-id": RequestID(ctx)})
+		return SpacePolicy{}, err
+	}
+
+	metrics.IncrementCounter("PolicyBrokerFailOpen")
+	c.logger.Error("failing-open", err, lager.Data{"space": space, "group": c.config.DefaultGroup, "request-id": RequestID(ctx)})
+
+	return SpacePolicy{Guid: space, Group: c.config.DefaultGroup}, nil
+}
+
+func (c *resilientClient) Groups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		groups, err = c.client.Groups(ctx)
+		return err
+	})
+
+	return groups, err
+}
+
+func (c *resilientClient) RegisterEndpoint(ctx context.Context, space string, endpoint string) (Endpoint, error) {
+	var registered Endpoint
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		registered, err = c.client.RegisterEndpoint(ctx, space, endpoint)
+		return err
+	})
+
+	return registered, err
+}
+
+func (c *resilientClient) DeregisterEndpoint(ctx context.Context, endpoint string) error {
+	return c.run(ctx, func(ctx context.Context) error {
+		return c.client.DeregisterEndpoint(ctx, endpoint)
+	})
+}
+
+func (c *resilientClient) Reconcile(ctx context.Context, req ReconcileRequest) (ReconcileResult, error) {
+	var result ReconcileResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = c.client.Reconcile(ctx, req)
+		return err
+	})
+
+	return result, err
+}
+
+// Ready is neither retried nor counted by the breaker, it is a diagnostic.
+func (c *resilientClient) Ready(ctx context.Context) (Readiness, error) {
+	return c.client.Ready(ctx)
+}
+
+// run retries work as the classifier allows, and stops waiting for the next
+// attempt as soon as ctx is done.
+func (c *resilientClient) run(ctx context.Context, work func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, work)
+		if (retryClassifier{}).Classify(err) != retrier.Retry || attempt >= len(c.backoff) {
+			return err
+		}
+
+		timer := time.NewTimer(c.backoff[attempt])
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *resilientClient) attempt(ctx context.Context, work func(context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// a 4xx is the caller's fault and must not open the breaker
+	var clientErr error
+	err := c.breaker.Run(func() error {
+		err := work(ctx)
+		if isClientError(err) {
+			clientErr = err
+			return nil
+		}
+		return err
+	})
+
+	switch {
+	case err == breaker.ErrBreakerOpen:
+		metrics.IncrementCounter("PolicyBrokerBreakerOpen")
+		return err
+	case err != nil:
+		metrics.IncrementCounter("PolicyBrokerRequestFailures")
+		return err
+	}
+
+	return clientErr
+}
+
+func isClientError(err error) bool {
+	brokerErr, ok := err.(Error)
+	return ok && brokerErr.StatusCode >= 400 && brokerErr.StatusCode < http.StatusInternalServerError
+}
+
+type retryClassifier struct{}
+
+func (retryClassifier) Classify(err error) retrier.Action {
+	switch {
+	case err == nil:
+		return retrier.Succeed
+	case err == breaker.ErrBreakerOpen, err == context.Canceled, err == context.DeadlineExceeded, isClientError(err):
+		return retrier.Fail
+	}
+
+	return retrier.Retry
+}
@@ -0,0 +1,164 @@
+package policyclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/eapache/go-resiliency/breaker"
+)
+
+// fakeBroker answers /v1/policy with the queued statuses, then with 200, and
+// counts the requests it gets.
+type fakeBroker struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests int
+}
+
+func (b *fakeBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	b.requests++
+	status := http.StatusOK
+	if len(b.statuses) > 0 {
+		status, b.statuses = b.statuses[0], b.statuses[1:]
+	}
+	b.mutex.Unlock()
+
+	if status != http.StatusOK {
+		http.Error(w, "broken", status)
+		return
+	}
+
+	json.NewEncoder(w).Encode(SpacePolicy{Guid: r.URL.Query().Get("space"), Group: "red"})
+}
+
+func (b *fakeBroker) fail(statuses ...int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.statuses = append(b.statuses, statuses...)
+}
+
+func (b *fakeBroker) received() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.requests
+}
+
+func newTestResilient(t *testing.T, config ResilienceConfig, statuses ...int) (Client, *fakeBroker) {
+	broker := &fakeBroker{statuses: statuses}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	client, err := New(Config{URL: server.URL, Timeout: time.Second}, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewResilient(client, config, lager.NewLogger("test")), broker
+}
+
+func TestResilientClientRetries(t *testing.T) {
+	config := ResilienceConfig{FailureMode: FailClosed, Retries: 2, RetryBackoff: time.Millisecond, BreakerErrors: 10, BreakerTimeout: time.Minute}
+
+	client, broker := newTestResilient(t, config, http.StatusInternalServerError, http.StatusBadGateway)
+	policy, err := client.SpacePolicy(context.Background(), "space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Group != "red" || broker.received() != 3 {
+		t.Errorf("got %+v after %d requests, want red after 3", policy, broker.received())
+	}
+
+	client, broker = newTestResilient(t, config, 500, 500, 500, 500)
+	if _, err := client.SpacePolicy(context.Background(), "space"); err == nil {
+		t.Error("expected the last failure once the retries are used up")
+	}
+	if got := broker.received(); got != 3 {
+		t.Errorf("%d requests, want 1 and 2 retries", got)
+	}
+
+	client, broker = newTestResilient(t, config, http.StatusNotFound)
+	_, err = client.SpacePolicy(context.Background(), "space")
+	if brokerErr, ok := err.(Error); !ok || brokerErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want the 404", err)
+	}
+	if got := broker.received(); got != 1 {
+		t.Errorf("%d requests, want a 4xx not to be retried", got)
+	}
+}
+
+func TestResilientClientBreaker(t *testing.T) {
+	config := ResilienceConfig{FailureMode: FailClosed, BreakerErrors: 2, BreakerTimeout: 50 * time.Millisecond}
+
+	client, broker := newTestResilient(t, config, http.StatusNotFound, 500, 500)
+
+	// the 4xx does not count towards opening the breaker
+	for i := 0; i < 3; i++ {
+		if _, err := client.SpacePolicy(context.Background(), "space"); err == nil {
+			t.Fatal("expected the broker to fail")
+		}
+	}
+
+	if _, err := client.SpacePolicy(context.Background(), "space"); err != breaker.ErrBreakerOpen {
+		t.Errorf("got %v, want the breaker to be open", err)
+	}
+	if got := broker.received(); got != 3 {
+		t.Errorf("%d requests, want none while the breaker is open", got)
+	}
+
+	// half-open: a failure opens it again right away
+	time.Sleep(60 * time.Millisecond)
+	broker.fail(500)
+	if _, err := client.SpacePolicy(context.Background(), "space"); err == nil || err == breaker.ErrBreakerOpen {
+		t.Errorf("got %v, want the broker to be tried again", err)
+	}
+	if _, err := client.SpacePolicy(context.Background(), "space"); err != breaker.ErrBreakerOpen {
+		t.Errorf("got %v, want the breaker to open again", err)
+	}
+
+	// half-open: a success closes it
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := client.SpacePolicy(context.Background(), "space"); err != nil {
+			t.Errorf("got %v, want the breaker to close", err)
+		}
+	}
+	if got := broker.received(); got != 6 {
+		t.Errorf("%d requests, want 6", got)
+	}
+}
+
+func TestResilientClientFailureModes(t *testing.T) {
+	config := ResilienceConfig{FailureMode: FailOpen, DefaultGroup: "blue", BreakerErrors: 10, BreakerTimeout: time.Minute}
+
+	client, _ := newTestResilient(t, config, 500, 500)
+	policy, err := client.SpacePolicy(context.Background(), "space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SpacePolicy{Guid: "space", Group: "blue"}); policy != want {
+		t.Errorf("got %+v, want fail-open to use the default group %+v", policy, want)
+	}
+	if _, err := client.RegisterEndpoint(context.Background(), "space", "10.0.0.1:60000"); err == nil {
+		t.Error("expected fail-open to leave endpoint registration failing")
+	}
+
+	client, _ = newTestResilient(t, config, http.StatusNotFound)
+	if _, err := client.SpacePolicy(context.Background(), "space"); err == nil {
+		t.Error("expected fail-open to return the broker's 4xx")
+	}
+
+	config.FailureMode = FailClosed
+	client, _ = newTestResilient(t, config, 500)
+	if _, err := client.SpacePolicy(context.Background(), "space"); err == nil {
+		t.Error("expected fail-closed to return the failure")
+	}
+}
@@ -2,40 +2,124 @@ package main
 
 import (
 	//"fmt"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
-	//"os"
+	"os"
 	//"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
-
-	"github.com/cloudfoundry-community/go-cfclient"
+	"sync"
+	"syscall"
+	"time"
 	//"github.com/urfave/cli"
+
+	"code.cloudfoundry.org/cflager"
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
 )
 
-type portGroup struct {
-	part1 string
-	part2 string
-}
+var listenNetwork = flag.String(
+	"listenNetwork",
+	"tcp",
+	"how to listen on the address (unix, tcp, etc.)",
+)
+
+var listenAddr = flag.String(
+	"listenAddr",
+	":"+policyclient.DefaultPort,
+	"address to listen on",
+)
 
-var endpointGroup map[string]portGroup
+var readTimeout = flag.Duration(
+	"readTimeout",
+	30*time.Second,
+	"maximum duration for reading an entire request",
+)
 
-var policytoGroup map[string]string
+var writeTimeout = flag.Duration(
+	"writeTimeout",
+	30*time.Second,
+	"maximum duration before timing out writes of a response",
+)
 
-type SpaceGroup struct {
-	Space    string `json:"space"`
-	Endpoint string `json:"endpoint"`
-}
+var idleTimeout = flag.Duration(
+	"idleTimeout",
+	2*time.Minute,
+	"how long an idle keep-alive connection is kept open",
+)
 
-func pol(w http.ResponseWriter, r *http.Request) {
-	//need to have space id for later association
-}
+var shutdownTimeout = flag.Duration(
+	"shutdownTimeout",
+	30*time.Second,
+	"how long in-flight requests are drained on SIGTERM before exiting",
+)
+
+var storePath = flag.String(
+	"storePath",
+	"",
+	"file in which to persist groups and endpoints (in-memory if empty)",
+)
+
+var configPath = flag.String(
+	"config",
+	"",
+	"JSON file defining groups and space matching rules; when set it is the only source of both and the API cannot change them (built-in defaults seed an empty store if unset)",
+)
+
+var spaceCacheTTL = flag.Duration(
+	"spaceCacheTTL",
+	5*time.Minute,
+	"how long a Cloud Controller space lookup is cached",
+)
+
+var spaceRefreshInterval = flag.Duration(
+	"spaceRefreshInterval",
+	time.Minute,
+	"interval at which the full space list is synced from Cloud Controller",
+)
+
+var backendName = flag.String(
+	"backend",
+	"noop",
+	"policy backend driver enforcing the groups ("+strings.Join(BackendNames(), ", ")+")",
+)
+
+var backendURL = flag.String(
+	"backendURL",
+	"",
+	"base URL of the controller used by the http backend",
+)
 
-func rule(w http.ResponseWriter, r *http.Request) {
+var backendTimeout = flag.Duration(
+	"backendTimeout",
+	10*time.Second,
+	"timeout of a single call to the policy backend",
+)
+
+type broker struct {
+	store    Store
+	config   configHolder
+	cache    *spaceCache
+	backend  PolicyBackend
+	audit    AuditLog
+	webhooks *webhookDispatcher
+	logger   lager.Logger
+
+	// configManaged is set when groups and rules come from -config only
+	configManaged bool
 
+	// apiMutex serializes check-then-write sequences against the store
+	apiMutex sync.Mutex
 }
 
-func sg(w http.ResponseWriter, r *http.Request) {
+func (b *broker) sg(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
 	switch r.Method {
 	case "GET":
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -46,13 +130,12 @@ func sg(w http.ResponseWriter, r *http.Request) {
 		}()
 		//todo: no talking with pg apis, find name from cf and parse it
 		space := r.URL.Query().Get("space")
-		fmt.Println(space)
-		policy := GetPolicy(space)
-		res := policytoGroup[policy]
-		if res == "" {
-			res = "0"
+		policy := b.GetPolicy(logger, space)
+		res := "0"
+		if group, err := b.store.Group(policy); err == nil {
+			res = strconv.Itoa(group.PoolID)
 		}
-		fmt.Println("sending back group id")
+		logger.Debug("sending-pool-id", lager.Data{"space": space, "group": policy, "pool-id": res})
 		w.Write([]byte(res))
 		//http.Error(w, "cannot find matching space", http.StatusBadRequest)
 		return
@@ -67,116 +150,562 @@ func sg(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "post data error", http.StatusBadRequest)
 			return
 		}
-		policy := GetPolicy(req.Space)
-
-		//PG can handle re-post,policy tag equals endpoint group tag
-		// create endpoint using port prefix
-		addEndpoint(policy, policy, req.Endpoint)
-
-		fmt.Println("got post data %s, %s", req.Space, req.Endpoint)
+		if _, err := b.registerEndpoint(logger, requestActor(r), req.Space, req.Endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	// Create a new record.
 	//case "PUT":
 	// Update an existing record.
 	case "DELETE":
-		// Remove the record.
+		// Remove a single endpoint, or every endpoint of a space.
+		endpoint := r.URL.Query().Get("endpoint")
 		space := r.URL.Query().Get("space")
-		fmt.Println("deleting from pg endpoint %s", space)
 
+		var err error
+		switch {
+		case endpoint != "":
+			_, err = b.deregisterEndpoint(logger, requestActor(r), endpoint)
+			if _, ok := err.(EndpointNotFoundError); ok {
+				err = nil
+			}
+		case space != "":
+			err = b.deregisterSpace(logger, requestActor(r), space)
+		default:
+			http.Error(w, "space or endpoint required", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 }
 
-func addEndPoint(req SpaceGroup) {
-	fmt.Println("Recieving endpoint from space %s, endpoint %s", req.Space, req.Endpoint)
+// pushGroup makes sure the group's policy and endpoint group exist in the
+// backend, policy tag equals endpoint group tag
+func (b *broker) pushGroup(logger lager.Logger, actor Actor, name string) error {
+	err := b.push(logger, actor, AuditEvent{Action: "create-policy", Group: name}, func() error {
+		return b.backend.CreatePolicy(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.push(logger, actor, AuditEvent{Action: "create-endpoint-group", Group: name}, func() error {
+		return b.backend.CreateEndpointGroup(name, name)
+	})
 }
-func addEndPointGroup(req SpaceGroup) {
-	fmt.Println("Create endpoint group %s.", req.Space, req.Endpoint)
+
+// registerEndpoint classifies the endpoint's space and adds it to the
+// resulting group, moving it out of its previous group if it changed.
+func (b *broker) registerEndpoint(logger lager.Logger, actor Actor, space string, address string) (Endpoint, error) {
+	policy := b.GetPolicy(logger, space)
+	endpoint := Endpoint{Space: space, Address: address, Group: policy}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	var before interface{}
+	previous, err := b.store.Endpoint(address)
+	existed := err == nil
+	if existed {
+		before = previous
+		if previous.Group != policy {
+			err := b.push(logger, actor, AuditEvent{Action: "remove-endpoint", Space: previous.Space, Group: previous.Group, Endpoint: address}, func() error {
+				return b.backend.RemoveEndpoint(previous.Group, address)
+			})
+			if err != nil {
+				return Endpoint{}, err
+			}
+		}
+	}
+
+	//PG can handle re-post,policy tag equals endpoint group tag
+	err = b.push(logger, actor, AuditEvent{Action: "add-endpoint", Space: space, Group: policy, Endpoint: address}, func() error {
+		return b.backend.AddEndpoint(policy, address)
+	})
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	if err := b.store.AddEndpoint(endpoint); err != nil {
+		return Endpoint{}, err
+	}
+
+	logger.Info("registered-endpoint", lager.Data{"space": space, "endpoint": address, "group": policy})
+	b.record(logger, actor, AuditEvent{Action: "register-endpoint", Space: space, Group: policy, Endpoint: address, Before: before, After: endpoint})
+
+	if !existed || previous.Group != policy {
+		if existed {
+			b.notify(actor, EventEndpointRemoved, previous)
+		}
+		b.notify(actor, EventEndpointAdded, endpoint)
+	}
+
+	return endpoint, nil
 }
 
-func createSpace() string {
-	return "uuid"
+func (b *broker) deregisterEndpoint(logger lager.Logger, actor Actor, address string) (Endpoint, error) {
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	endpoint, err := b.store.Endpoint(address)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	err = b.push(logger, actor, AuditEvent{Action: "remove-endpoint", Space: endpoint.Space, Group: endpoint.Group, Endpoint: address}, func() error {
+		return b.backend.RemoveEndpoint(endpoint.Group, address)
+	})
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	if err := b.store.RemoveEndpoint(address); err != nil {
+		return Endpoint{}, err
+	}
+
+	logger.Info("deregistered-endpoint", lager.Data{"space": endpoint.Space, "endpoint": address, "group": endpoint.Group})
+	b.record(logger, actor, AuditEvent{Action: "deregister-endpoint", Space: endpoint.Space, Group: endpoint.Group, Endpoint: address, Before: endpoint})
+	b.notify(actor, EventEndpointRemoved, endpoint)
+
+	return endpoint, nil
 }
 
-func createPolicy(name string) {
-	//todo: need a floating ip
+func (b *broker) deregisterSpace(logger lager.Logger, actor Actor, space string) error {
+	endpoints, err := b.store.Endpoints()
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.Space != space {
+			continue
+		}
+
+		_, err := b.deregisterEndpoint(logger, actor, endpoint.Address)
+		if _, ok := err.(EndpointNotFoundError); err != nil && !ok {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func createEndGroup(name string, policy string) {
-	//todo: need the tenant id
+// seedConfig stores the config's groups in a store that has no groups, and
+// its rules in a store that has no rules. It is how the built-in defaults
+// are applied: from then on groups and rules are managed through the API.
+func (b *broker) seedConfig(logger lager.Logger, actor Actor, config *Config) error {
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	groups, err := b.store.Groups()
+	if err != nil {
+		return err
+	}
+
+	if len(groups) == 0 {
+		for _, group := range config.Groups {
+			if err := b.pushGroup(logger, actor, group.Name); err != nil {
+				return err
+			}
+		}
+
+		for _, group := range config.Groups {
+			if err := b.store.PutGroup(group); err != nil {
+				return err
+			}
+
+			b.record(logger, actor, AuditEvent{Action: "put-group", Group: group.Name, After: group})
+		}
+	}
+
+	rules, err := b.store.Rules()
+	if err != nil {
+		return err
+	}
+
+	if len(rules) > 0 {
+		return nil
+	}
+
+	if err := b.store.SetRules(config.Rules); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "set-rules", After: config.Rules})
+
+	return nil
 }
 
-func addEndpoint(space string, policy string, ipPort string) {
+// applyConfig makes the config's groups and rules the only ones in the
+// store. It is how a -config file is applied, at startup and on SIGHUP: the
+// file is then the only source of groups and rules, and the API refuses to
+// change them. A group the config drops must no longer have endpoints or
+// overrides. The store is changed in a single write, after the new groups
+// exist in the backend, so a failure leaves the previous config in place.
+func (b *broker) applyConfig(logger lager.Logger, actor Actor, config *Config) error {
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	groups, err := b.store.Groups()
+	if err != nil {
+		return err
+	}
+
+	rules, err := b.store.Rules()
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]Group, len(groups))
+	for _, group := range groups {
+		previous[group.Name] = group
+	}
+
+	kept := make(map[string]bool, len(config.Groups))
+	for _, group := range config.Groups {
+		kept[group.Name] = true
+	}
 
+	var dropped []string
+	for _, group := range groups {
+		if !kept[group.Name] {
+			dropped = append(dropped, group.Name)
+		}
+	}
+
+	if err := b.checkUnused(dropped); err != nil {
+		return err
+	}
+
+	for _, group := range config.Groups {
+		if _, found := previous[group.Name]; !found {
+			if err := b.pushGroup(logger, actor, group.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.store.ReplaceConfig(config.Groups, config.Rules); err != nil {
+		return err
+	}
+
+	for _, group := range config.Groups {
+		if before, found := previous[group.Name]; !found || !sameGroup(before, group) {
+			event := AuditEvent{Action: "put-group", Group: group.Name, After: group}
+			if found {
+				event.Before = before
+			}
+			b.record(logger, actor, event)
+		}
+	}
+
+	for _, name := range dropped {
+		b.record(logger, actor, AuditEvent{Action: "delete-group", Group: name, Before: previous[name]})
+
+		// the store no longer has the group, so a failure here only leaves an
+		// empty endpoint group behind in the backend
+		err := b.push(logger, actor, AuditEvent{Action: "delete-endpoint-group", Group: name}, func() error {
+			return b.backend.DeleteEndpointGroup(name)
+		})
+		if err != nil {
+			logger.Error("failed-to-delete-endpoint-group", err, lager.Data{"group": name})
+		}
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "set-rules", Before: rules, After: config.Rules})
+
+	return nil
 }
 
-func deleteSpace() {
+// checkUnused must be called with the apiMutex held. It fails if an endpoint
+// or an override is in one of the groups.
+func (b *broker) checkUnused(groups []string) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool, len(groups))
+	for _, name := range groups {
+		names[name] = true
+	}
+
+	overrides, err := b.store.Overrides()
+	if err != nil {
+		return err
+	}
+
+	for _, override := range overrides {
+		if names[override.Group] {
+			return ConflictError{fmt.Sprintf("group %s is used by the override of space %s", override.Group, override.Space)}
+		}
+	}
+
+	endpoints, err := b.store.Endpoints()
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		if names[endpoint.Group] {
+			return ConflictError{fmt.Sprintf("group %s still has endpoints", endpoint.Group)}
+		}
+	}
 
+	return nil
 }
 
-func delEndGroup(space string) {
-	//delete endpoint group
+func sameGroup(a, b Group) bool {
+	return a.PoolID == b.PoolID && strings.Join(a.PortRanges, ",") == strings.Join(b.PortRanges, ",")
 }
 
-func config() {
-	//conatins the hard coded stuff
-	policytoGroup["blue"] = "0"
-	policytoGroup["green"] = "1"
-	policytoGroup["red"] = "2"
-	endpointGroup["blue"] = portGroup{part1: "59392/1024", part2: "60416/1024"}
-	endpointGroup["green"] = portGroup{part1: "61440/1024", part2: "62464/1024"}
-	endpointGroup["red"] = portGroup{part1: "63488/1023", part2: "64512/1023"}
-	createPolicy("blue")
-	createPolicy("green")
-	createPolicy("red")
-	createEndGroup("red", "red")
-	createEndGroup("green", "green")
-	createEndGroup("blue", "blue")
+func (b *broker) reloadConfig() error {
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := b.applyConfig(b.logger.Session("reload-config"), systemActor, config); err != nil {
+		return err
+	}
+
+	b.config.Set(config)
+	return nil
 }
 
-func GetPolicy(spaceid string) string {
-	c := &cfclient.Config{
-		ApiAddress: "https://api.cf.plumgrid.com",
-		Username:   "admin",
-		Password:   "plumgrid",
+func (b *broker) GetPolicy(logger lager.Logger, spaceid string) string {
+	space, err := b.lookupSpace(spaceid)
+	if err != nil {
+		// explicit space guid rules still apply
+		logger.Info("space-lookup-failed", lager.Data{"space": spaceid, "error": err.Error()})
+		space = SpaceInfo{Guid: spaceid}
 	}
 
-	client, _ := cfclient.NewClient(c)
-	fmt.println(client == nil)
-	spaces, _ := client.ListSpaces()
-	for _, s := range spaces {
-		if s.Guid == spaceid {
-			return parse(strings.ToLower(s.Name))
-		}
+	policy, err := b.classify(space)
+	if err != nil {
+		logger.Error("failed-to-classify", err, lager.Data{"space": spaceid})
+		return b.config.Get().DefaultGroup
 	}
 
-	return "blue"
+	logger.Debug("classified", lager.Data{"space": spaceid, "group": policy})
 
+	return policy
 }
 
-func parse(name string) string {
-	//hard coded
-	switch {
-	case strings.Contains(name, "dev"):
-		return "blue"
-	case strings.Contains(name, "int"):
-		return "green"
-	case strings.Contains(name, "prod"):
-		return "red"
+// classify consults the space's override before any rule.
+func (b *broker) classify(space SpaceInfo) (string, error) {
+	override, err := b.store.Override(space.Guid)
+	switch err.(type) {
+	case nil:
+		return override.Group, nil
+	case OverrideNotFoundError:
+	default:
+		return "", err
 	}
-	return "blue"
 
+	rules, err := b.store.Rules()
+	if err != nil {
+		return "", err
+	}
+
+	return MatchRules(rules, b.config.Get().DefaultGroup, space), nil
+}
+
+func (b *broker) lookupSpace(guid string) (SpaceInfo, error) {
+	return b.cache.Space(guid)
+}
+
+func (b *broker) listSpaces() ([]SpaceInfo, error) {
+	return b.cache.Spaces()
 }
 
 func main() {
+	cflager.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, _ := cflager.New("policy-broker")
+
+	if *webhookQueueSize < 1 || *webhookDeadLetters < 0 || *webhookHistory < 0 {
+		logger.Fatal("invalid-webhook-configuration", fmt.Errorf("-webhookQueueSize must be at least 1, -webhookDeadLetters and -webhookHistory must not be negative"))
+	}
+
+	// with no rotated files, rotating would delete the current one
+	if *auditLogMaxSize <= 0 || *auditLogMaxFiles < 1 {
+		logger.Fatal("invalid-audit-log-configuration", fmt.Errorf("-auditLogMaxSize and -auditLogMaxFiles must be at least 1"))
+	}
+
+	authConfig, err := ResolveAuthConfig()
+	if err != nil {
+		logger.Fatal("invalid-auth-configuration", err)
+	}
+
+	tlsConfig, err := NewTLSConfig(authConfig)
+	if err != nil {
+		logger.Fatal("invalid-tls-configuration", err)
+	}
+
+	store := NewMemoryStore()
+	if *storePath != "" {
+		store, err = NewFileStore(*storePath)
+		if err != nil {
+			logger.Fatal("failed-to-open-store", err, lager.Data{"path": *storePath})
+		}
+	}
+
+	config := &defaultConfig
+	if *configPath != "" {
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			logger.Fatal("failed-to-load-config", err, lager.Data{"path": *configPath})
+		}
+	} else if err := config.Validate(); err != nil {
+		panic(err) // should never happen..
+	}
+
+	ccConfig, err := ResolveCloudControllerConfig(config.CloudController)
+	if err != nil {
+		logger.Fatal("invalid-cloud-controller-configuration", err)
+	}
+
+	ccClient, err := NewCloudControllerClient(ccConfig)
+	if err != nil {
+		logger.Fatal("failed-to-authenticate-with-cloud-controller", err, lager.Data{"api": ccConfig.API})
+	}
+
+	audit := NewNoopAuditLog()
+	if *auditLogPath != "" {
+		audit, err = NewFileAuditLog(*auditLogPath, *auditLogMaxSize, *auditLogMaxFiles, logger)
+		if err != nil {
+			logger.Fatal("failed-to-open-audit-log", err, lager.Data{"path": *auditLogPath})
+		}
+	}
+
+	backend, err := NewBackend(*backendName, BackendOptions{
+		URL:     *backendURL,
+		Timeout: *backendTimeout,
+		Logger:  logger.Session("backend", lager.Data{"driver": *backendName}),
+	})
+	if err != nil {
+		logger.Fatal("failed-to-create-backend", err)
+	}
+
+	b := &broker{
+		store:    store,
+		cache:    NewSpaceCache(instrumentedDirectory{NewCFSpaceDirectory(ccClient)}, *spaceCacheTTL, logger),
+		backend:  instrumentedBackend{backend},
+		audit:    audit,
+		webhooks: NewWebhookDispatcher(store, *webhookTimeout, *webhookMaxAttempts, *webhookRetryInterval, *webhookHistory, *webhookDeadLetters, *webhookQueueSize, logger),
+		logger:   logger,
+	}
+
+	if *configPath != "" {
+		b.configManaged = true
+		err = b.applyConfig(logger.Session("apply-config"), systemActor, config)
+	} else {
+		err = b.seedConfig(logger.Session("seed-config"), systemActor, config)
+	}
+	if err != nil {
+		logger.Fatal("failed-to-apply-config", err)
+	}
+
+	b.config.Set(config)
+
+	stopRefresh := make(chan struct{})
+	go b.cache.Run(*spaceRefreshInterval, stopRefresh)
+
+	if *configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := b.reloadConfig(); err != nil {
+					logger.Error("failed-to-reload-config", err)
+					continue
+				}
+				logger.Info("reloaded-config", lager.Data{"path": *configPath})
+			}
+		}()
+	}
 
-	policytoGroup = make(map[string]string)
-	endpointGroup = make(map[string]portGroup)
-	config()
 	mux := http.NewServeMux()
-	mux.HandleFunc("/spacegroup", sg)
-	mux.HandleFunc("/policytag", pol)
-	mux.HandleFunc("/rule", rule)
-	http.ListenAndServe(":8000", mux)
+	mux.HandleFunc("/spacegroup", b.sg)
+	b.registerAPI(mux)
+
+	listener, err := listen(*listenNetwork, *listenAddr)
+	if err != nil {
+		logger.Fatal("failed-to-listen", err)
+	}
+
+	server := &http.Server{
+		Handler:      withRequestLogging(logger, instrument(mux, requireAuth(authConfig, mux))),
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	logger.Info("started", lager.Data{
+		"network": *listenNetwork,
+		"addr":    *listenAddr,
+		"tls":     tlsConfig != nil,
+	})
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-served:
+		store.Close()
+		audit.Close()
+		logger.Fatal("server-stopped", err)
+	case sig := <-term:
+		logger.Info("shutting-down", lager.Data{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("failed-to-drain-requests", err)
+	}
+
+	close(stopRefresh)
+	b.webhooks.Stop()
+
+	if err := audit.Close(); err != nil {
+		logger.Error("failed-to-close-audit-log", err)
+	}
+
+	if err := store.Close(); err != nil {
+		logger.Fatal("failed-to-flush-store", err)
+	}
+
+	logger.Info("stopped")
+}
+
+// listen removes a stale unix socket left behind by a previous run.
+func listen(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
 
+	return net.Listen(network, address)
 }
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (err InvalidRequestError) Error() string {
+	return fmt.Sprintf("invalid request: %s", err.Reason)
+}
+
+type ConflictError struct {
+	Reason string
+}
+
+func (err ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %s", err.Reason)
+}
+
+type SpaceNotFoundError struct {
+	Guid string
+}
+
+func (err SpaceNotFoundError) Error() string {
+	return fmt.Sprintf("space does not exist: %s", err.Guid)
+}
+
+func (b *broker) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/groups", b.groups)
+	mux.HandleFunc("/v1/groups/", b.group)
+	mux.HandleFunc("/v1/rules", b.rules)
+	mux.HandleFunc("/v1/rules/", b.rule)
+	mux.HandleFunc("/v1/endpoints", b.endpoints)
+	mux.HandleFunc("/v1/endpoints/", b.endpoint)
+	mux.HandleFunc("/v1/spaces", b.spaces)
+	mux.HandleFunc("/v1/spaces/", b.space)
+	mux.HandleFunc("/v1/overrides", b.overrides)
+	mux.HandleFunc("/v1/policy", b.policy)
+	mux.HandleFunc("/v1/explain", b.explain)
+	mux.HandleFunc("/v1/reconcile", b.reconcileHandler)
+	mux.HandleFunc("/v1/audit", b.auditQuery)
+	mux.HandleFunc("/v1/webhooks", b.webhooksHandler)
+	mux.HandleFunc("/v1/webhooks/", b.webhookHandler)
+	mux.HandleFunc("/metrics", b.metrics)
+	mux.HandleFunc("/healthz", b.healthz)
+	mux.HandleFunc("/readyz", b.readyz)
+}
+
+func (b *broker) groups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		groups, err := b.store.Groups()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, groups)
+
+	case "POST":
+		var group Group
+		if err := decodeJSON(r, &group); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := b.createGroup(requestLogger(r), requestActor(r), group); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, group)
+
+	default:
+		methodNotAllowed(w, "GET", "POST")
+	}
+}
+
+func (b *broker) group(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "/v1/groups/")
+
+	switch r.Method {
+	case "GET":
+		group, err := b.store.Group(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, group)
+
+	case "PUT":
+		var group Group
+		if err := decodeJSON(r, &group); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if group.Name == "" {
+			group.Name = name
+		}
+
+		if group.Name != name {
+			writeError(w, InvalidRequestError{"group name cannot be changed"})
+			return
+		}
+
+		if err := b.updateGroup(requestLogger(r), requestActor(r), group); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, group)
+
+	case "DELETE":
+		if err := b.deleteGroup(requestLogger(r), requestActor(r), name); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+func (b *broker) createGroup(logger lager.Logger, actor Actor, group Group) error {
+	if err := b.checkWritable("groups"); err != nil {
+		return err
+	}
+
+	if problems := validateGroup(group); len(problems) > 0 {
+		return InvalidRequestError{strings.Join(problems, "; ")}
+	}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	if _, err := b.store.Group(group.Name); err == nil {
+		return ConflictError{fmt.Sprintf("group %s already exists", group.Name)}
+	}
+
+	if err := b.checkPoolID(group); err != nil {
+		return err
+	}
+
+	if err := b.pushGroup(logger, actor, group.Name); err != nil {
+		return err
+	}
+
+	if err := b.store.PutGroup(group); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "create-group", Group: group.Name, After: group})
+
+	return nil
+}
+
+func (b *broker) updateGroup(logger lager.Logger, actor Actor, group Group) error {
+	if err := b.checkWritable("groups"); err != nil {
+		return err
+	}
+
+	if problems := validateGroup(group); len(problems) > 0 {
+		return InvalidRequestError{strings.Join(problems, "; ")}
+	}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	previous, err := b.store.Group(group.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := b.checkPoolID(group); err != nil {
+		return err
+	}
+
+	if err := b.store.PutGroup(group); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "update-group", Group: group.Name, Before: previous, After: group})
+
+	return nil
+}
+
+// checkPoolID must be called with the apiMutex held.
+func (b *broker) checkPoolID(group Group) error {
+	groups, err := b.store.Groups()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range groups {
+		if other.Name != group.Name && other.PoolID == group.PoolID {
+			return ConflictError{fmt.Sprintf("pool_id %d already used by group %s", group.PoolID, other.Name)}
+		}
+	}
+
+	return nil
+}
+
+func (b *broker) deleteGroup(logger lager.Logger, actor Actor, name string) error {
+	if err := b.checkWritable("groups"); err != nil {
+		return err
+	}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	previous, err := b.store.Group(name)
+	if err != nil {
+		return err
+	}
+
+	if name == b.config.Get().DefaultGroup {
+		return ConflictError{fmt.Sprintf("group %s is the default group", name)}
+	}
+
+	rules, err := b.store.Rules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if rule.Group == name {
+			return ConflictError{fmt.Sprintf("group %s is used by rule %s", name, rule.ID)}
+		}
+	}
+
+	if err := b.checkUnused([]string{name}); err != nil {
+		return err
+	}
+
+	err = b.push(logger, actor, AuditEvent{Action: "delete-endpoint-group", Group: name}, func() error {
+		return b.backend.DeleteEndpointGroup(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := b.store.DeleteGroup(name); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "delete-group", Group: name, Before: previous})
+
+	return nil
+}
+
+// checkWritable refuses API changes to what a -config file manages.
+func (b *broker) checkWritable(what string) error {
+	if b.configManaged {
+		return ConflictError{fmt.Sprintf("%s are managed by the config file", what)}
+	}
+
+	return nil
+}
+
+func (b *broker) rules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rules, err := b.store.Rules()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rules)
+
+	case "POST":
+		var rule Rule
+		if err := decodeJSON(r, &rule); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if rule.ID == "" {
+			rule.ID = newID()
+		}
+
+		if err := b.putRule(requestLogger(r), requestActor(r), rule, false); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, rule)
+
+	default:
+		methodNotAllowed(w, "GET", "POST")
+	}
+}
+
+func (b *broker) rule(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "/v1/rules/")
+
+	switch r.Method {
+	case "GET":
+		rule, err := b.store.Rule(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rule)
+
+	case "PUT":
+		var rule Rule
+		if err := decodeJSON(r, &rule); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if rule.ID == "" {
+			rule.ID = id
+		}
+
+		if rule.ID != id {
+			writeError(w, InvalidRequestError{"rule id cannot be changed"})
+			return
+		}
+
+		if err := b.putRule(requestLogger(r), requestActor(r), rule, true); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rule)
+
+	case "DELETE":
+		if err := b.deleteRule(requestLogger(r), requestActor(r), id); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+// putRule creates the rule, or replaces an existing one when update is set.
+func (b *broker) putRule(logger lager.Logger, actor Actor, rule Rule, update bool) error {
+	if err := b.checkWritable("rules"); err != nil {
+		return err
+	}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	groups, err := b.store.Groups()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, group := range groups {
+		names[group.Name] = true
+	}
+
+	if problems := rule.validate(names); len(problems) > 0 {
+		return InvalidRequestError{strings.Join(problems, "; ")}
+	}
+
+	previous, err := b.store.Rule(rule.ID)
+	switch {
+	case update && err != nil:
+		return err
+	case !update && err == nil:
+		return ConflictError{fmt.Sprintf("rule %s already exists", rule.ID)}
+	}
+
+	if err := b.store.PutRule(rule); err != nil {
+		return err
+	}
+
+	event := AuditEvent{Action: "create-rule", Group: rule.Group, Rule: rule.ID, After: rule}
+	if update {
+		event.Action = "update-rule"
+		event.Before = previous
+	}
+	b.record(logger, actor, event)
+
+	return nil
+}
+
+func (b *broker) deleteRule(logger lager.Logger, actor Actor, id string) error {
+	if err := b.checkWritable("rules"); err != nil {
+		return err
+	}
+
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	previous, err := b.store.Rule(id)
+	if err != nil {
+		return err
+	}
+
+	if err := b.store.DeleteRule(id); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "delete-rule", Group: previous.Group, Rule: id, Before: previous})
+
+	return nil
+}
+
+func (b *broker) endpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		endpoints, err := b.store.Endpoints()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		space := r.URL.Query().Get("space")
+		group := r.URL.Query().Get("group")
+
+		filtered := []Endpoint{}
+		for _, endpoint := range endpoints {
+			if (space == "" || endpoint.Space == space) && (group == "" || endpoint.Group == group) {
+				filtered = append(filtered, endpoint)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, filtered)
+
+	case "POST":
+		var req SpaceGroup
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if req.Endpoint == "" || req.Space == "" {
+			writeError(w, InvalidRequestError{"space and endpoint are required"})
+			return
+		}
+
+		endpoint, err := b.registerEndpoint(requestLogger(r), requestActor(r), req.Space, req.Endpoint)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, endpoint)
+
+	default:
+		methodNotAllowed(w, "GET", "POST")
+	}
+}
+
+func (b *broker) endpoint(w http.ResponseWriter, r *http.Request) {
+	address := pathParam(r, "/v1/endpoints/")
+
+	switch r.Method {
+	case "GET":
+		endpoint, err := b.store.Endpoint(address)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, endpoint)
+
+	case "DELETE":
+		if _, err := b.deregisterEndpoint(requestLogger(r), requestActor(r), address); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "DELETE")
+	}
+}
+
+func (b *broker) spaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	spaces, err := b.listSpaces()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	policies := make([]SpacePolicy, 0, len(spaces))
+	for _, space := range spaces {
+		policy, err := b.spacePolicy(space)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		policies = append(policies, policy)
+	}
+
+	writeJSON(w, http.StatusOK, policies)
+}
+
+func (b *broker) space(w http.ResponseWriter, r *http.Request) {
+	guid := pathParam(r, "/v1/spaces/")
+
+	if strings.HasSuffix(guid, "/group") {
+		b.spaceGroup(w, r, strings.TrimSuffix(guid, "/group"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		space, err := b.lookupSpace(guid)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		policy, err := b.spacePolicy(space)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, policy)
+
+	case "DELETE":
+		if err := b.deregisterSpace(requestLogger(r), requestActor(r), guid); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "DELETE")
+	}
+}
+
+// policy is what garden asks before mapping a port: unlike /v1/spaces/{guid}
+// it always answers, falling back to the default group.
+func (b *broker) policy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	guid := r.URL.Query().Get("space")
+
+	space, err := b.lookupSpace(guid)
+	if err != nil {
+		space = SpaceInfo{Guid: guid}
+	}
+
+	policy, err := b.spacePolicy(space)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+}
+
+// explain shows which rule /v1/policy applies to a space and why.
+func (b *broker) explain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	guid := r.URL.Query().Get("space")
+	if guid == "" {
+		writeError(w, InvalidRequestError{"space is required"})
+		return
+	}
+
+	space, err := b.lookupSpace(guid)
+	known := err == nil
+	if !known {
+		space = SpaceInfo{Guid: guid}
+	}
+
+	explanation, err := b.explainSpace(space)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	explanation.SpaceKnown = known
+
+	writeJSON(w, http.StatusOK, explanation)
+}
+
+// explainSpace reports an override instead of the rules when there is one.
+func (b *broker) explainSpace(space SpaceInfo) (Explanation, error) {
+	override, err := b.store.Override(space.Guid)
+	switch err.(type) {
+	case nil:
+		return Explanation{Space: space, Group: override.Group, Override: &override, Evaluated: []RuleResult{}}, nil
+	case OverrideNotFoundError:
+	default:
+		return Explanation{}, err
+	}
+
+	rules, err := b.store.Rules()
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	return ExplainRules(rules, b.config.Get().DefaultGroup, space), nil
+}
+
+func (b *broker) spacePolicy(space SpaceInfo) (SpacePolicy, error) {
+	groupName, err := b.classify(space)
+	if err != nil {
+		return SpacePolicy{}, err
+	}
+
+	group, err := b.store.Group(groupName)
+	if err != nil {
+		return SpacePolicy{}, err
+	}
+
+	return SpacePolicy{
+		Guid:    space.Guid,
+		Name:    space.Name,
+		OrgName: space.OrgName,
+		Group:   group.Name,
+		PoolID:  group.PoolID,
+	}, nil
+}
+
+func pathParam(r *http.Request, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return InvalidRequestError{err.Error()}
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if recorder, ok := w.(*responseRecorder); ok {
+		recorder.err = err
+	}
+
+	status := http.StatusInternalServerError
+
+	switch err.(type) {
+	case InvalidRequestError:
+		status = http.StatusBadRequest
+	case GroupNotFoundError, EndpointNotFoundError, RuleNotFoundError, SpaceNotFoundError, OverrideNotFoundError, AuditDisabledError,
+		WebhookNotFoundError, DeliveryNotFoundError:
+		status = http.StatusNotFound
+	case ConflictError:
+		status = http.StatusConflict
+	case UnauthorizedError:
+		status = http.StatusUnauthorized
+	}
+
+	writeJSON(w, status, policyclient.ErrorResponse{Error: err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, policyclient.ErrorResponse{Error: "method not allowed"})
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %s", err)) // should never happen..
+	}
+
+	return hex.EncodeToString(buf)
+}
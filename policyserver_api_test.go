@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+)
+
+func TestWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{InvalidRequestError{"bad"}, http.StatusBadRequest},
+		{GroupNotFoundError{"purple"}, http.StatusNotFound},
+		{EndpointNotFoundError{"10.0.0.1:60000"}, http.StatusNotFound},
+		{RuleNotFoundError{"rule"}, http.StatusNotFound},
+		{SpaceNotFoundError{"space"}, http.StatusNotFound},
+		{OverrideNotFoundError{"space"}, http.StatusNotFound},
+		{AuditDisabledError{}, http.StatusNotFound},
+		{WebhookNotFoundError{"hook"}, http.StatusNotFound},
+		{DeliveryNotFoundError{"delivery"}, http.StatusNotFound},
+		{ConflictError{"taken"}, http.StatusConflict},
+		{UnauthorizedError{}, http.StatusUnauthorized},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		recorder := httptest.NewRecorder()
+		writeError(recorder, tc.err)
+
+		if recorder.Code != tc.status {
+			t.Errorf("%T: status %d, want %d", tc.err, recorder.Code, tc.status)
+		}
+		if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+			t.Errorf("%T: content type %q", tc.err, got)
+		}
+
+		var response policyclient.ErrorResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error != tc.err.Error() {
+			t.Errorf("%T: error %q, want %q", tc.err, response.Error, tc.err.Error())
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, server, _ := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	resp, err := http.Post(server.URL+"/v1/groups", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want 400", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+		error  string
+	}{
+		{"GET", "/v1/groups/purple", nil, http.StatusNotFound, "group does not exist: purple"},
+		{"POST", "/v1/groups", Group{Name: "blue", PoolID: 7, PortRanges: []string{"50000/10"}}, http.StatusConflict, "conflict: group blue already exists"},
+		{"DELETE", "/v1/groups/blue", nil, http.StatusConflict, "conflict: group blue is the default group"},
+		{"PUT", "/v1/groups/blue", Group{Name: "red", PoolID: 0, PortRanges: []string{"59392/1024"}}, http.StatusBadRequest, "invalid request: group name cannot be changed"},
+		{"PATCH", "/v1/groups", nil, http.StatusMethodNotAllowed, "method not allowed"},
+	} {
+		var response policyclient.ErrorResponse
+		if status := apiRequest(t, server, tc.method, tc.path, tc.body, &response); status != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, status, tc.status)
+		}
+		if response.Error != tc.error {
+			t.Errorf("%s %s: error %q, want %q", tc.method, tc.path, response.Error, tc.error)
+		}
+	}
+}
+
+func TestConfigManagedGroupsAndRulesAreReadOnly(t *testing.T) {
+	b, server, _ := newTestBroker(t, AuthConfig{})
+	b.configManaged = true
+	server.Start()
+
+	var rules []Rule
+	if status := apiRequest(t, server, "GET", "/v1/rules", nil, &rules); status != http.StatusOK || len(rules) == 0 {
+		t.Fatalf("status %d, rules %+v", status, rules)
+	}
+	rule := rules[0]
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   interface{}
+		error  string
+	}{
+		{"POST", "/v1/groups", Group{Name: "purple", PoolID: 3, PortRanges: []string{"50000/10"}}, "conflict: groups are managed by the config file"},
+		{"PUT", "/v1/groups/green", Group{Name: "green", PoolID: 1, PortRanges: []string{"50000/10"}}, "conflict: groups are managed by the config file"},
+		{"DELETE", "/v1/groups/green", nil, "conflict: groups are managed by the config file"},
+		{"POST", "/v1/rules", Rule{Group: "green", SpaceName: "staging"}, "conflict: rules are managed by the config file"},
+		{"PUT", "/v1/rules/" + rule.ID, rule, "conflict: rules are managed by the config file"},
+		{"DELETE", "/v1/rules/" + rule.ID, nil, "conflict: rules are managed by the config file"},
+	} {
+		var response policyclient.ErrorResponse
+		if status := apiRequest(t, server, tc.method, tc.path, tc.body, &response); status != http.StatusConflict {
+			t.Errorf("%s %s: status %d, want 409", tc.method, tc.path, status)
+		}
+		if response.Error != tc.error {
+			t.Errorf("%s %s: error %q, want %q", tc.method, tc.path, response.Error, tc.error)
+		}
+	}
+
+	var groups []Group
+	apiRequest(t, server, "GET", "/v1/groups", nil, &groups)
+	if len(groups) != len(defaultConfig.Groups) {
+		t.Errorf("groups %+v, want them unchanged", groups)
+	}
+	if status := apiRequest(t, server, "GET", "/v1/rules", nil, &rules); status != http.StatusOK || len(rules) != len(defaultConfig.Rules) {
+		t.Errorf("status %d, rules %+v, want them unchanged", status, rules)
+	}
+}
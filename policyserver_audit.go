@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+var auditLogPath = flag.String(
+	"auditLog",
+	"",
+	"JSON lines file recording every change made through the API and every backend push (disabled if empty)",
+)
+
+var auditLogMaxSize = flag.Int64(
+	"auditLogMaxSize",
+	10*1024*1024,
+	"size in bytes at which the audit log is rotated",
+)
+
+var auditLogMaxFiles = flag.Int(
+	"auditLogMaxFiles",
+	5,
+	"number of rotated audit log files kept besides the current one (at least 1)",
+)
+
+// Actor is who a change is attributed to in the audit log.
+type Actor struct {
+	Name      string
+	RequestID string
+}
+
+// systemActor makes the changes the broker does on its own, such as
+// applying the config at startup or on SIGHUP.
+var systemActor = Actor{Name: "system"}
+
+// requestActor attributes a change to whoever made the request.
+func requestActor(r *http.Request) Actor {
+	return Actor{Name: principal(r), RequestID: requestID(r)}
+}
+
+// AuditEvent is one line of the audit log. Before and After hold the
+// affected object as it was and as it became, whichever apply.
+type AuditEvent struct {
+	Time      time.Time   `json:"time"`
+	Actor     string      `json:"actor"`
+	RequestID string      `json:"request_id,omitempty"`
+	Action    string      `json:"action"`
+	Space     string      `json:"space,omitempty"`
+	Group     string      `json:"group,omitempty"`
+	Endpoint  string      `json:"endpoint,omitempty"`
+	Rule      string      `json:"rule,omitempty"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// AuditFilter selects events; zero fields match everything. Limit keeps only
+// the most recent events.
+type AuditFilter struct {
+	Space  string
+	Group  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	switch {
+	case f.Space != "" && event.Space != f.Space:
+		return false
+	case f.Group != "" && event.Group != f.Group:
+		return false
+	case f.Action != "" && event.Action != f.Action:
+		return false
+	case !f.Since.IsZero() && event.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !event.Time.Before(f.Until):
+		return false
+	}
+
+	return true
+}
+
+type AuditDisabledError struct{}
+
+func (err AuditDisabledError) Error() string {
+	return "audit log is disabled"
+}
+
+type AuditLog interface {
+	Record(event AuditEvent) error
+	Query(filter AuditFilter) ([]AuditEvent, error)
+	Close() error
+}
+
+type noopAuditLog struct{}
+
+func NewNoopAuditLog() AuditLog {
+	return noopAuditLog{}
+}
+
+func (noopAuditLog) Record(event AuditEvent) error {
+	return nil
+}
+
+func (noopAuditLog) Query(filter AuditFilter) ([]AuditEvent, error) {
+	return nil, AuditDisabledError{}
+}
+
+func (noopAuditLog) Close() error {
+	return nil
+}
+
+// fileAuditLog appends to filePath and, once it would grow past maxSize,
+// renames it to filePath.1, shifting older files up to filePath.<maxFiles>.
+type fileAuditLog struct {
+	filePath string
+	maxSize  int64
+	maxFiles int
+	logger   lager.Logger
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+
+	// shifted is set once rotate renamed the files but could not open a new
+	// one; file is then still written to, as filePath.1
+	shifted bool
+}
+
+func NewFileAuditLog(filePath string, maxSize int64, maxFiles int, logger lager.Logger) (AuditLog, error) {
+	log := &fileAuditLog{
+		filePath: filePath,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		logger:   logger.Session("audit-log"),
+	}
+
+	file, size, err := openAuditFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.file = file
+	log.size = size
+
+	return log, nil
+}
+
+func openAuditFile(filePath string) (*os.File, int64, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening audit log: %s", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("opening audit log: %s", err)
+	}
+
+	return file, info.Size(), nil
+}
+
+func (l *fileAuditLog) Record(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding audit event: %s", err)
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		// the event is still written, to the file that is too big
+		if err := l.rotate(); err != nil {
+			l.logger.Error("failed-to-rotate", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing audit log: %s", err)
+	}
+
+	return l.file.Sync()
+}
+
+// rotate must be called with the mutex held. The current file is only
+// closed once the new one is open, so that a failure leaves it being written
+// to; the next rotate then only retries opening the new file.
+func (l *fileAuditLog) rotate() error {
+	if !l.shifted {
+		if err := os.Remove(l.rotated(l.maxFiles)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotating audit log: %s", err)
+		}
+
+		for i := l.maxFiles - 1; i >= 0; i-- {
+			if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("rotating audit log: %s", err)
+			}
+		}
+
+		l.shifted = true
+	}
+
+	file, size, err := openAuditFile(l.filePath)
+	if err != nil {
+		return err
+	}
+
+	if err := l.file.Close(); err != nil {
+		l.logger.Error("failed-to-close-rotated-file", err)
+	}
+
+	l.file = file
+	l.size = size
+	l.shifted = false
+
+	l.logger.Info("rotated", lager.Data{"max-files": l.maxFiles})
+
+	return nil
+}
+
+// rotated returns the path of the i-th rotated file, 0 being the current one.
+func (l *fileAuditLog) rotated(i int) string {
+	if i == 0 {
+		return l.filePath
+	}
+
+	return l.filePath + "." + strconv.Itoa(i)
+}
+
+// Query reads every file, oldest first. Lines that cannot be parsed, such as
+// one cut short by a crash, are skipped.
+func (l *fileAuditLog) Query(filter AuditFilter) ([]AuditEvent, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := []AuditEvent{}
+	for i := l.maxFiles; i >= 0; i-- {
+		file, err := os.Open(l.rotated(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading audit log: %s", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				l.logger.Info("skipping-malformed-line", lager.Data{"file": file.Name(), "error": err.Error()})
+				continue
+			}
+
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+		}
+
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading audit log: %s", err)
+		}
+	}
+
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+
+	return events, nil
+}
+
+func (l *fileAuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Close()
+}
+
+// record writes event to the audit log. A failure is only logged: the change
+// it describes has already been made.
+func (b *broker) record(logger lager.Logger, actor Actor, event AuditEvent) {
+	event.Time = time.Now().UTC()
+	event.Actor = actor.Name
+	event.RequestID = actor.RequestID
+
+	if err := b.audit.Record(event); err != nil {
+		logger.Error("failed-to-record-audit-event", err, lager.Data{"action": event.Action})
+	}
+}
+
+// push makes a backend call and records it, whether or not it succeeded.
+func (b *broker) push(logger lager.Logger, actor Actor, event AuditEvent, call func() error) error {
+	err := call()
+
+	event.Action = "backend." + event.Action
+	if err != nil {
+		event.Error = err.Error()
+	}
+	b.record(logger, actor, event)
+
+	return err
+}
+
+func (b *broker) auditQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Space:  query.Get("space"),
+		Group:  query.Get("group"),
+		Action: query.Get("action"),
+	}
+
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, InvalidRequestError{fmt.Sprintf("%s must be an RFC 3339 time", param)})
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, InvalidRequestError{"limit must be a non-negative integer"})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := b.audit.Query(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "audit.log")
+
+	// every event after the first rotates the file
+	audit, err := NewFileAuditLog(filePath, 1, 2, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	for _, space := range []string{"s1", "s2", "s3", "s4", "s5"} {
+		if err := audit.Record(AuditEvent{Action: "register-endpoint", Space: space}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(filePath), name)); err != nil {
+			t.Errorf("expected %s to exist: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(filePath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept, got %v", err)
+	}
+
+	events, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spaces []string
+	for _, event := range events {
+		spaces = append(spaces, event.Space)
+	}
+	if want := []string{"s3", "s4", "s5"}; !reflect.DeepEqual(spaces, want) {
+		t.Errorf("spaces %v, want the newest %v, oldest first", spaces, want)
+	}
+}
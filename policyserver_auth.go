@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var tlsCert = flag.String(
+	"tlsCert",
+	"",
+	"PEM certificate to serve the API over TLS with (requires -tlsKey)",
+)
+
+var tlsKey = flag.String(
+	"tlsKey",
+	"",
+	"PEM private key of -tlsCert",
+)
+
+var tlsClientCA = flag.String(
+	"tlsClientCA",
+	"",
+	"PEM file of CA certificates; clients must present a certificate signed by one of them, unless they send -authToken instead",
+)
+
+var authToken = flag.String(
+	"authToken",
+	"",
+	"bearer token clients must send in the Authorization header",
+)
+
+var authTokenFile = flag.String(
+	"authTokenFile",
+	"",
+	"file containing the bearer token, instead of -authToken",
+)
+
+type UnauthorizedError struct{}
+
+func (err UnauthorizedError) Error() string {
+	return "unauthorized"
+}
+
+// AuthConfig is how the API authenticates garden. With neither a client CA
+// nor a token every request is accepted; with both either one suffices.
+type AuthConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	Token        string
+}
+
+func (config AuthConfig) TLSEnabled() bool {
+	return config.CertFile != ""
+}
+
+// ResolveAuthConfig reads the auth flags and the token file.
+func ResolveAuthConfig() (AuthConfig, error) {
+	config := AuthConfig{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ClientCAFile: *tlsClientCA,
+		Token:        *authToken,
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return config, errors.New("-tlsCert and -tlsKey must be given together")
+	}
+
+	if config.ClientCAFile != "" && !config.TLSEnabled() {
+		return config, errors.New("-tlsClientCA requires -tlsCert and -tlsKey")
+	}
+
+	if *authTokenFile != "" {
+		if config.Token != "" {
+			return config, errors.New("-authToken and -authTokenFile are mutually exclusive")
+		}
+
+		contents, err := ioutil.ReadFile(*authTokenFile)
+		if err != nil {
+			return config, fmt.Errorf("reading token file: %s", err)
+		}
+
+		config.Token = strings.TrimSpace(string(contents))
+		if config.Token == "" {
+			return config, fmt.Errorf("token file %s is empty", *authTokenFile)
+		}
+	}
+
+	return config, nil
+}
+
+// NewTLSConfig returns nil if TLS is not enabled. Client certificates are
+// only required when there is no token to fall back to; requireAuth checks
+// the request either way.
+func NewTLSConfig(config AuthConfig) (*tls.Config, error) {
+	if !config.TLSEnabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.Token != "" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+type principalKey struct{}
+
+// requireAuth lets a request through if it came with a verified client
+// certificate or the bearer token, and tags it with who that proved it to
+// be. Health probes are always let through, authenticated or not. Without
+// any auth configured every request is "anonymous".
+func requireAuth(config AuthConfig, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := authenticate(config, r)
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, name))
+		}
+
+		if ok || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="policy-broker"`)
+		writeError(w, UnauthorizedError{})
+	})
+}
+
+func authenticate(config AuthConfig, r *http.Request) (string, bool) {
+	if config.ClientCAFile == "" && config.Token == "" {
+		return "anonymous", true
+	}
+
+	if config.ClientCAFile != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+
+	if config.Token != "" && validToken(r, config.Token) {
+		return "token", true
+	}
+
+	return "", false
+}
+
+// principal names who requireAuth verified the request came from: the
+// client certificate's common name, or the bearer token. It is empty for a
+// health probe that did not authenticate.
+func principal(r *http.Request) string {
+	name, _ := r.Context().Value(principalKey{}).(string)
+	return name
+}
+
+func validToken(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
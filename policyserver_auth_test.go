@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+// testCA issues certificates for the tests, written as PEM files.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{dir: dir, cert: cert, key: key, file: filepath.Join(dir, name+".crt")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+
+	return ca
+}
+
+// issue writes a certificate for name, valid for 127.0.0.1, and its key, and
+// returns their paths.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, filePath, blockType string, der []byte) {
+	if err := ioutil.WriteFile(filePath, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startTLSBroker(t *testing.T, auth AuthConfig) string {
+	tlsConfig, err := NewTLSConfig(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, server, _ := newTestBroker(t, auth)
+	server.TLS = tlsConfig
+	server.StartTLS()
+
+	return server.URL
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	rogueCA := newTestCA(t, dir, "rogue-ca")
+
+	serverCert, serverKey := ca.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "garden", x509.ExtKeyUsageClientAuth)
+	rogueCert, rogueKey := rogueCA.issue(t, "rogue", x509.ExtKeyUsageClientAuth)
+
+	url := startTLSBroker(t, AuthConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.file})
+
+	for _, tc := range []struct {
+		name              string
+		certFile, keyFile string
+		succeeds          bool
+	}{
+		{"trusted client certificate", clientCert, clientKey, true},
+		{"no client certificate", "", "", false},
+		{"client certificate of another CA", rogueCert, rogueKey, false},
+	} {
+		client, err := policyclient.New(policyclient.Config{
+			URL:        url,
+			Timeout:    time.Second,
+			CACertFile: ca.file,
+			CertFile:   tc.certFile,
+			KeyFile:    tc.keyFile,
+		}, lager.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Groups(context.Background())
+		if tc.succeeds != (err == nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+
+	if _, err := policyclient.New(policyclient.Config{URL: "http://127.0.0.1:1", CACertFile: ca.file}, lager.NewLogger("test")); err == nil {
+		t.Error("expected TLS with an http URL to be rejected")
+	}
+}
+
+func TestClientCertificateNamesTheActor(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "garden", x509.ExtKeyUsageClientAuth)
+
+	url := startTLSBroker(t, AuthConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.file})
+
+	keyPair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{keyPair},
+	}}}
+
+	req, _ := http.NewRequest("PUT", url+"/v1/spaces/dev-guid/group", bytes.NewBufferString(`{"group":"red"}`))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var override Override
+	if err := json.NewDecoder(resp.Body).Decode(&override); err != nil {
+		t.Fatal(err)
+	}
+	if override.SetBy != "cert:garden" {
+		t.Errorf("override set by %q, want cert:garden", override.SetBy)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	_, server, _ := newTestBroker(t, AuthConfig{Token: "s3cret"})
+	server.Start()
+
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"s3cret", 0},
+		{"wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		client, err := policyclient.New(policyclient.Config{URL: server.URL, Timeout: time.Second, Token: tc.token}, lager.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Groups(context.Background())
+		switch {
+		case tc.status == 0 && err != nil:
+			t.Errorf("token %q: unexpected error %v", tc.token, err)
+		case tc.status != 0 && err != (policyclient.Error{StatusCode: tc.status, Message: "unauthorized"}):
+			t.Errorf("token %q: got %v, want %d", tc.token, err, tc.status)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unauthenticated /healthz answered %d", resp.StatusCode)
+	}
+}
+
+func TestTokenInsteadOfClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+
+	url := startTLSBroker(t, AuthConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.file, Token: "s3cret"})
+
+	client, err := policyclient.New(policyclient.Config{URL: url, Timeout: time.Second, CACertFile: ca.file, Token: "s3cret"}, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Groups(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// PolicyBackend enforces groups on the network, e.g. an SDN controller.
+// Every call must be idempotent; the broker re-pushes state freely.
+type PolicyBackend interface {
+	CreatePolicy(name string) error
+	CreateEndpointGroup(name string, policy string) error
+	DeleteEndpointGroup(name string) error
+	AddEndpoint(group string, address string) error
+	RemoveEndpoint(group string, address string) error
+}
+
+type BackendOptions struct {
+	URL     string
+	Timeout time.Duration
+	Logger  lager.Logger
+}
+
+type BackendFactory func(options BackendOptions) (PolicyBackend, error)
+
+var backendsMutex sync.Mutex
+var backends = make(map[string]BackendFactory)
+
+// RegisterBackend makes a driver selectable by name with -backend.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	if _, found := backends[name]; found {
+		panic(fmt.Sprintf("backend already registered: %s", name))
+	}
+
+	backends[name] = factory
+}
+
+func NewBackend(name string, options BackendOptions) (PolicyBackend, error) {
+	backendsMutex.Lock()
+	factory, found := backends[name]
+	backendsMutex.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("unknown backend %q, available: %v", name, BackendNames())
+	}
+
+	return factory(options)
+}
+
+func BackendNames() []string {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func init() {
+	RegisterBackend("noop", func(options BackendOptions) (PolicyBackend, error) {
+		return noopBackend{logger: options.Logger}, nil
+	})
+
+	RegisterBackend("memory", func(BackendOptions) (PolicyBackend, error) {
+		return NewMemoryBackend(), nil
+	})
+}
+
+// noopBackend only logs what it would have done, for development.
+type noopBackend struct {
+	logger lager.Logger
+}
+
+func (b noopBackend) CreatePolicy(name string) error {
+	b.logger.Info("create-policy", lager.Data{"policy": name})
+	return nil
+}
+
+func (b noopBackend) CreateEndpointGroup(name string, policy string) error {
+	b.logger.Info("create-endpoint-group", lager.Data{"group": name, "policy": policy})
+	return nil
+}
+
+func (b noopBackend) DeleteEndpointGroup(name string) error {
+	b.logger.Info("delete-endpoint-group", lager.Data{"group": name})
+	return nil
+}
+
+func (b noopBackend) AddEndpoint(group string, address string) error {
+	b.logger.Info("add-endpoint", lager.Data{"group": group, "endpoint": address})
+	return nil
+}
+
+func (b noopBackend) RemoveEndpoint(group string, address string) error {
+	b.logger.Info("remove-endpoint", lager.Data{"group": group, "endpoint": address})
+	return nil
+}
+
+// MemoryBackend records the state it has been told about, so that tests can
+// inspect what the broker pushed.
+type MemoryBackend struct {
+	mutex     sync.RWMutex
+	policies  map[string]bool
+	groups    map[string]string
+	endpoints map[string]map[string]bool
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		policies:  make(map[string]bool),
+		groups:    make(map[string]string),
+		endpoints: make(map[string]map[string]bool),
+	}
+}
+
+func (m *MemoryBackend) CreatePolicy(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.policies[name] = true
+	return nil
+}
+
+func (m *MemoryBackend) CreateEndpointGroup(name string, policy string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.policies[policy] {
+		return fmt.Errorf("policy does not exist: %s", policy)
+	}
+
+	m.groups[name] = policy
+	if m.endpoints[name] == nil {
+		m.endpoints[name] = make(map[string]bool)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) DeleteEndpointGroup(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.groups, name)
+	delete(m.endpoints, name)
+	return nil
+}
+
+func (m *MemoryBackend) AddEndpoint(group string, address string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, found := m.groups[group]; !found {
+		return fmt.Errorf("endpoint group does not exist: %s", group)
+	}
+
+	m.endpoints[group][address] = true
+	return nil
+}
+
+func (m *MemoryBackend) RemoveEndpoint(group string, address string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.endpoints[group], address)
+	return nil
+}
+
+// Endpoints returns the sorted addresses in group.
+func (m *MemoryBackend) Endpoints(group string) []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	addresses := make([]string, 0, len(m.endpoints[group]))
+	for address := range m.endpoints[group] {
+		addresses = append(addresses, address)
+	}
+
+	sort.Strings(addresses)
+
+	return addresses
+}
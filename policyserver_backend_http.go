@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("http", NewHTTPBackend)
+}
+
+// httpBackend pushes endpoint group membership to a REST controller:
+//
+//	PUT    {url}/policies/{policy}
+//	PUT    {url}/endpoint_groups/{group}                      {"policy": "..."}
+//	DELETE {url}/endpoint_groups/{group}
+//	PUT    {url}/endpoint_groups/{group}/endpoints/{address}
+//	DELETE {url}/endpoint_groups/{group}/endpoints/{address}
+//
+// A 404 on DELETE counts as success. The controller counts as healthy while
+// GET {url}/ answers with anything but a 5xx.
+type httpBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPBackend(options BackendOptions) (PolicyBackend, error) {
+	if options.URL == "" {
+		return nil, errors.New("http backend: missing -backendURL")
+	}
+
+	if _, err := url.Parse(options.URL); err != nil {
+		return nil, fmt.Errorf("http backend: invalid -backendURL: %s", err)
+	}
+
+	return &httpBackend{
+		baseURL: strings.TrimSuffix(options.URL, "/"),
+		client:  &http.Client{Timeout: options.Timeout},
+	}, nil
+}
+
+func (h *httpBackend) CreatePolicy(name string) error {
+	return h.do("PUT", "/policies/"+url.PathEscape(name), nil)
+}
+
+func (h *httpBackend) CreateEndpointGroup(name string, policy string) error {
+	body := map[string]string{"policy": policy}
+	return h.do("PUT", "/endpoint_groups/"+url.PathEscape(name), body)
+}
+
+func (h *httpBackend) DeleteEndpointGroup(name string) error {
+	return h.do("DELETE", "/endpoint_groups/"+url.PathEscape(name), nil)
+}
+
+func (h *httpBackend) AddEndpoint(group string, address string) error {
+	return h.do("PUT", "/endpoint_groups/"+url.PathEscape(group)+"/endpoints/"+url.PathEscape(address), nil)
+}
+
+func (h *httpBackend) RemoveEndpoint(group string, address string) error {
+	return h.do("DELETE", "/endpoint_groups/"+url.PathEscape(group)+"/endpoints/"+url.PathEscape(address), nil)
+}
+
+func (h *httpBackend) Healthy() error {
+	resp, err := h.client.Get(h.baseURL + "/")
+	if err != nil {
+		return fmt.Errorf("http backend: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("http backend: GET /: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (h *httpBackend) do(method string, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, h.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http backend: %s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if method == "DELETE" && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("http backend: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+func TestBackendRegistry(t *testing.T) {
+	for _, name := range []string{"http", "memory", "noop"} {
+		found := false
+		for _, registered := range BackendNames() {
+			found = found || registered == name
+		}
+		if !found {
+			t.Errorf("backend %s is not registered: %v", name, BackendNames())
+		}
+	}
+
+	backend, err := NewBackend("memory", BackendOptions{Logger: lager.NewLogger("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.(*MemoryBackend); !ok {
+		t.Errorf("got %T, want *MemoryBackend", backend)
+	}
+
+	if _, err := NewBackend("plumgrid", BackendOptions{}); err == nil {
+		t.Error("expected an unknown backend to fail")
+	}
+}
+
+func TestMemoryBackendRequiresPolicyAndGroup(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	if err := backend.CreateEndpointGroup("red", "red"); err == nil {
+		t.Error("expected creating a group without its policy to fail")
+	}
+	if err := backend.AddEndpoint("red", "10.0.0.1:60000"); err == nil {
+		t.Error("expected adding to a missing group to fail")
+	}
+}
+
+func TestBrokerPushesToBackend(t *testing.T) {
+	_, server, backend := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	for _, group := range []string{"blue", "green", "red"} {
+		if err := backend.AddEndpoint(group, "probe"); err != nil {
+			t.Errorf("group %s was not created in the backend: %s", group, err)
+		}
+		backend.RemoveEndpoint(group, "probe")
+	}
+
+	client, err := policyclient.New(policyclient.Config{URL: server.URL, Timeout: time.Second}, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	endpoint, err := client.RegisterEndpoint(ctx, "prod-guid", "10.0.0.1:63332")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Group != "red" {
+		t.Errorf("endpoint registered in %s, want red", endpoint.Group)
+	}
+	if got := backend.Endpoints("red"); !reflect.DeepEqual(got, []string{"10.0.0.1:63332"}) {
+		t.Errorf("backend red endpoints %v", got)
+	}
+
+	if err := client.DeregisterEndpoint(ctx, "10.0.0.1:63332"); err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.Endpoints("red"); len(got) != 0 {
+		t.Errorf("backend red endpoints %v, want none", got)
+	}
+}
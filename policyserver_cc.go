@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// CloudControllerConfig is how the broker reaches Cloud Controller. Client
+// credentials are preferred over a username and password.
+type CloudControllerConfig struct {
+	API               string `json:"api"`
+	ClientID          string `json:"client_id,omitempty"`
+	ClientSecret      string `json:"client_secret,omitempty"`
+	Username          string `json:"username,omitempty"`
+	Password          string `json:"password,omitempty"`
+	SkipSSLValidation bool   `json:"skip_ssl_validation,omitempty"`
+	CACertFile        string `json:"ca_cert_file,omitempty"`
+}
+
+var ccAPI = flag.String(
+	"ccAPI",
+	"",
+	"Cloud Controller API address (env CC_API)",
+)
+
+var ccClientID = flag.String(
+	"ccClientID",
+	"",
+	"UAA client used with the client_credentials grant (env CC_CLIENT_ID)",
+)
+
+var ccClientSecret = flag.String(
+	"ccClientSecret",
+	"",
+	"secret of -ccClientID (env CC_CLIENT_SECRET)",
+)
+
+var ccUsername = flag.String(
+	"ccUsername",
+	"",
+	"Cloud Controller user, only used without -ccClientID (env CC_USERNAME)",
+)
+
+var ccPassword = flag.String(
+	"ccPassword",
+	"",
+	"password of -ccUsername (env CC_PASSWORD)",
+)
+
+var ccSkipSSLValidation = flag.Bool(
+	"ccSkipSSLValidation",
+	false,
+	"skip verification of the Cloud Controller and UAA certificates (env CC_SKIP_SSL_VALIDATION)",
+)
+
+var ccCACert = flag.String(
+	"ccCACert",
+	"",
+	"PEM file of CA certificates to trust for Cloud Controller and UAA (env CC_CA_CERT)",
+)
+
+// ResolveCloudControllerConfig layers, from lowest to highest precedence, the
+// config file section, the environment and the flags set on the command line.
+func ResolveCloudControllerConfig(fromFile *CloudControllerConfig) (CloudControllerConfig, error) {
+	var config CloudControllerConfig
+	if fromFile != nil {
+		config = *fromFile
+	}
+
+	overrideString(&config.API, "CC_API", "ccAPI", *ccAPI)
+	overrideString(&config.ClientID, "CC_CLIENT_ID", "ccClientID", *ccClientID)
+	overrideString(&config.ClientSecret, "CC_CLIENT_SECRET", "ccClientSecret", *ccClientSecret)
+	overrideString(&config.Username, "CC_USERNAME", "ccUsername", *ccUsername)
+	overrideString(&config.Password, "CC_PASSWORD", "ccPassword", *ccPassword)
+	overrideString(&config.CACertFile, "CC_CA_CERT", "ccCACert", *ccCACert)
+
+	if value := os.Getenv("CC_SKIP_SSL_VALIDATION"); value != "" {
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			return CloudControllerConfig{}, fmt.Errorf("CC_SKIP_SSL_VALIDATION: %s", err)
+		}
+		config.SkipSSLValidation = skip
+	}
+	if flagSet("ccSkipSSLValidation") {
+		config.SkipSSLValidation = *ccSkipSSLValidation
+	}
+
+	if config.API == "" {
+		return CloudControllerConfig{}, errors.New("missing Cloud Controller API address")
+	}
+
+	if config.ClientID == "" && config.Username == "" {
+		return CloudControllerConfig{}, errors.New("missing Cloud Controller client id or username")
+	}
+
+	return config, nil
+}
+
+func overrideString(value *string, envName, flagName, flagValue string) {
+	if env := os.Getenv(envName); env != "" {
+		*value = env
+	}
+
+	if flagSet(flagName) {
+		*value = flagValue
+	}
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// NewCloudControllerClient builds a client and makes sure it can
+// authenticate, so that bad credentials are reported at startup.
+func NewCloudControllerClient(config CloudControllerConfig) (*cfclient.Client, error) {
+	cfConfig := &cfclient.Config{
+		ApiAddress:        config.API,
+		SkipSslValidation: config.SkipSSLValidation,
+	}
+
+	if config.ClientID != "" {
+		cfConfig.ClientID = config.ClientID
+		cfConfig.ClientSecret = config.ClientSecret
+	} else {
+		cfConfig.Username = config.Username
+		cfConfig.Password = config.Password
+	}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in %s", config.CACertFile)
+		}
+
+		cfConfig.HttpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					RootCAs:            pool,
+					InsecureSkipVerify: config.SkipSSLValidation,
+				},
+			},
+		}
+	}
+
+	client, err := cfclient.NewClient(cfConfig)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to cloud controller %s: %s", config.API, err)
+	}
+
+	if _, err := client.GetToken(); err != nil {
+		return nil, fmt.Errorf("authenticating with cloud controller %s: %s", config.API, err)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+)
+
+// Config is the declarative broker configuration loaded from -config.
+type Config struct {
+	DefaultGroup string  `json:"default_group"`
+	Groups       []Group `json:"groups"`
+	Rules        []Rule  `json:"rules"`
+
+	// CloudController is only read at startup.
+	CloudController *CloudControllerConfig `json:"cloud_controller,omitempty"`
+}
+
+// Rule assigns spaces to Group. Every criterion that is set must match.
+// Rules are evaluated by descending Priority, rules of equal priority in
+// order, and the first match wins.
+//
+// SpaceName, OrgName and the values of Labels and Annotations are regular
+// expressions; a label or annotation must be set on the space for its
+// expression to be tried.
+type Rule struct {
+	ID          string            `json:"id"`
+	Group       string            `json:"group"`
+	Priority    int               `json:"priority,omitempty"`
+	SpaceName   string            `json:"space_name,omitempty"`
+	OrgName     string            `json:"org_name,omitempty"`
+	SpaceGuids  []string          `json:"space_guids,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	spaceName   *regexp.Regexp
+	orgName     *regexp.Regexp
+	labels      map[string]*regexp.Regexp
+	annotations map[string]*regexp.Regexp
+}
+
+// SpaceInfo is what rules are matched against.
+type SpaceInfo struct {
+	Guid        string            `json:"guid"`
+	Name        string            `json:"name,omitempty"`
+	OrgName     string            `json:"org_name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// defaultConfig reproduces the groups and the dev/int/prod name matching the
+// broker used to have compiled in, except that prod takes precedence over int
+// and int over dev, so that e.g. "devops-prod" is red.
+var defaultConfig = Config{
+	DefaultGroup: "blue",
+	Groups: []Group{
+		{Name: "blue", PoolID: 0, PortRanges: []string{"59392/1024", "60416/1024"}},
+		{Name: "green", PoolID: 1, PortRanges: []string{"61440/1024", "62464/1024"}},
+		{Name: "red", PoolID: 2, PortRanges: []string{"63488/1023", "64512/1023"}},
+	},
+	Rules: []Rule{
+		{Group: "blue", SpaceName: "dev"},
+		{Group: "green", SpaceName: "int", Priority: 1},
+		{Group: "red", SpaceName: "prod", Priority: 2},
+	},
+}
+
+type ConfigError struct {
+	Errors []string
+}
+
+func (err ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(err.Errors, "; "))
+}
+
+func LoadConfig(filePath string) (*Config, error) {
+	configFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening config file: %s", err)
+	}
+	defer configFile.Close()
+
+	var config Config
+	decoder := json.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("parsing config file: %s", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Validate checks the config and compiles its rules. All problems are
+// reported together. Rules without an ID are numbered by position.
+func (c *Config) Validate() error {
+	var errs []string
+
+	if len(c.Groups) == 0 {
+		errs = append(errs, "no groups defined")
+	}
+
+	names := make(map[string]bool)
+	poolIDs := make(map[int]string)
+	for i, group := range c.Groups {
+		for _, problem := range validateGroup(group) {
+			errs = append(errs, fmt.Sprintf("groups[%d]: %s", i, problem))
+		}
+
+		if names[group.Name] {
+			errs = append(errs, fmt.Sprintf("groups[%d]: duplicate name %q", i, group.Name))
+		}
+		names[group.Name] = true
+
+		if other, found := poolIDs[group.PoolID]; found {
+			errs = append(errs, fmt.Sprintf("groups[%d]: pool_id %d already used by %q", i, group.PoolID, other))
+		}
+		poolIDs[group.PoolID] = group.Name
+	}
+
+	if c.DefaultGroup == "" {
+		errs = append(errs, "missing default_group")
+	} else if !names[c.DefaultGroup] {
+		errs = append(errs, fmt.Sprintf("default_group: unknown group %q", c.DefaultGroup))
+	}
+
+	ids := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("config-%d", i)
+		}
+
+		if ids[rule.ID] {
+			errs = append(errs, fmt.Sprintf("rules[%d]: duplicate id %q", i, rule.ID))
+		}
+		ids[rule.ID] = true
+
+		for _, problem := range rule.validate(names) {
+			errs = append(errs, fmt.Sprintf("rules[%d]: %s", i, problem))
+		}
+	}
+
+	if len(errs) > 0 {
+		return ConfigError{errs}
+	}
+
+	return nil
+}
+
+func validateGroup(g Group) []string {
+	var problems []string
+
+	if g.Name == "" {
+		problems = append(problems, "missing name")
+	}
+
+	if g.PoolID < 0 {
+		problems = append(problems, fmt.Sprintf("negative pool_id %d", g.PoolID))
+	}
+
+	for _, portRange := range g.PortRanges {
+		if _, _, err := policyclient.ParsePortRange(portRange); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
+
+// validate checks the rule against the known group names and compiles it.
+func (r *Rule) validate(groups map[string]bool) []string {
+	var problems []string
+
+	if !groups[r.Group] {
+		problems = append(problems, fmt.Sprintf("unknown group %q", r.Group))
+	}
+
+	if r.SpaceName == "" && r.OrgName == "" && len(r.SpaceGuids) == 0 && len(r.Labels) == 0 && len(r.Annotations) == 0 {
+		problems = append(problems, "no space_name, org_name, space_guids, labels or annotations")
+	}
+
+	if err := r.compile(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return problems
+}
+
+// MatchRules returns the group of the first rule matching space, or
+// defaultGroup.
+func MatchRules(rules []Rule, defaultGroup string, space SpaceInfo) string {
+	for _, rule := range ordered(rules) {
+		if rule.Matches(space) {
+			return rule.Group
+		}
+	}
+
+	return defaultGroup
+}
+
+// Explanation is how a space was classified: every rule in evaluation order
+// up to and including the one that matched, with the reason for each outcome.
+// A space with an override never gets to the rules.
+type Explanation struct {
+	Space      SpaceInfo    `json:"space"`
+	SpaceKnown bool         `json:"space_known"`
+	Group      string       `json:"group"`
+	Override   *Override    `json:"override,omitempty"`
+	Rule       string       `json:"rule,omitempty"`
+	Default    bool         `json:"default"`
+	Evaluated  []RuleResult `json:"evaluated"`
+}
+
+type RuleResult struct {
+	ID       string   `json:"id"`
+	Group    string   `json:"group"`
+	Priority int      `json:"priority"`
+	Matched  bool     `json:"matched"`
+	Reasons  []string `json:"reasons"`
+}
+
+// ExplainRules is MatchRules, reporting its work.
+func ExplainRules(rules []Rule, defaultGroup string, space SpaceInfo) Explanation {
+	explanation := Explanation{Space: space, Evaluated: []RuleResult{}}
+
+	for _, rule := range ordered(rules) {
+		matched, reasons := rule.evaluate(space)
+		explanation.Evaluated = append(explanation.Evaluated, RuleResult{
+			ID:       rule.ID,
+			Group:    rule.Group,
+			Priority: rule.Priority,
+			Matched:  matched,
+			Reasons:  reasons,
+		})
+
+		if matched {
+			explanation.Group = rule.Group
+			explanation.Rule = rule.ID
+			return explanation
+		}
+	}
+
+	explanation.Group = defaultGroup
+	explanation.Default = true
+
+	return explanation
+}
+
+// ordered sorts by descending priority, keeping the order of equal ones.
+func ordered(rules []Rule) []Rule {
+	sorted := make([]Rule, len(rules))
+	copy(sorted, rules)
+
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+
+	return sorted
+}
+
+func (r *Rule) compile() error {
+	var err error
+
+	r.spaceName = nil
+	if r.SpaceName != "" {
+		if r.spaceName, err = regexp.Compile(r.SpaceName); err != nil {
+			return fmt.Errorf("space_name: %s", err)
+		}
+	}
+
+	r.orgName = nil
+	if r.OrgName != "" {
+		if r.orgName, err = regexp.Compile(r.OrgName); err != nil {
+			return fmt.Errorf("org_name: %s", err)
+		}
+	}
+
+	if r.labels, err = compileAll("labels", r.Labels); err != nil {
+		return err
+	}
+
+	if r.annotations, err = compileAll("annotations", r.Annotations); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func compileAll(field string, expressions map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(expressions) == 0 {
+		return nil, nil
+	}
+
+	compiled := make(map[string]*regexp.Regexp, len(expressions))
+	for key, expression := range expressions {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%s]: %s", field, key, err)
+		}
+		compiled[key] = re
+	}
+
+	return compiled, nil
+}
+
+func (r Rule) Matches(space SpaceInfo) bool {
+	matched, _ := r.evaluate(space)
+	return matched
+}
+
+// evaluate stops at the first criterion that does not match; the reasons
+// list what was checked up to there.
+func (r Rule) evaluate(space SpaceInfo) (bool, []string) {
+	var reasons []string
+
+	check := func(field string, re *regexp.Regexp, value string) bool {
+		if re.MatchString(value) {
+			reasons = append(reasons, fmt.Sprintf("%s %q matches %q", field, value, re))
+			return true
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %q does not match %q", field, value, re))
+		return false
+	}
+
+	if r.spaceName != nil && !check("space_name", r.spaceName, space.Name) {
+		return false, reasons
+	}
+
+	if r.orgName != nil && !check("org_name", r.orgName, space.OrgName) {
+		return false, reasons
+	}
+
+	if len(r.SpaceGuids) > 0 {
+		found := false
+		for _, guid := range r.SpaceGuids {
+			if guid == space.Guid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			reasons = append(reasons, fmt.Sprintf("space guid %s is not in space_guids", space.Guid))
+			return false, reasons
+		}
+		reasons = append(reasons, fmt.Sprintf("space guid %s is in space_guids", space.Guid))
+	}
+
+	for _, set := range []struct {
+		field    string
+		compiled map[string]*regexp.Regexp
+		values   map[string]string
+	}{
+		{"label", r.labels, space.Labels},
+		{"annotation", r.annotations, space.Annotations},
+	} {
+		for _, key := range sortedRegexpKeys(set.compiled) {
+			value, found := set.values[key]
+			if !found {
+				reasons = append(reasons, fmt.Sprintf("%s %s is not set", set.field, key))
+				return false, reasons
+			}
+
+			if !check(set.field+" "+key, set.compiled[key], value) {
+				return false, reasons
+			}
+		}
+	}
+
+	return true, reasons
+}
+
+func sortedRegexpKeys(compiled map[string]*regexp.Regexp) []string {
+	keys := make([]string, 0, len(compiled))
+	for key := range compiled {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configHolder lets the config be swapped on SIGHUP while requests are
+// being served.
+type configHolder struct {
+	mutex  sync.RWMutex
+	config *Config
+}
+
+func (h *configHolder) Get() *Config {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.config
+}
+
+func (h *configHolder) Set(config *Config) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.config = config
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func validConfig(t *testing.T, config Config) Config {
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestDefaultConfigRules(t *testing.T) {
+	config := defaultConfig
+	config.Rules = append([]Rule(nil), defaultConfig.Rules...)
+	config = validConfig(t, config)
+
+	for _, tc := range []struct {
+		space string
+		group string
+	}{
+		{"my-dev", "blue"},
+		{"integration", "green"},
+		{"prod", "red"},
+		{"devops-prod", "red"},
+		{"dev-int", "green"},
+		{"PROD", "blue"}, // case-sensitive, like the old strings.Contains
+		{"staging", "blue"},
+	} {
+		if got := MatchRules(config.Rules, config.DefaultGroup, SpaceInfo{Name: tc.space}); got != tc.group {
+			t.Errorf("space %s: got %s, want %s", tc.space, got, tc.group)
+		}
+	}
+}
+
+func TestRulePriorityAndOrder(t *testing.T) {
+	config := validConfig(t, Config{
+		DefaultGroup: "blue",
+		Groups:       []Group{{Name: "blue", PoolID: 0}, {Name: "green", PoolID: 1}, {Name: "red", PoolID: 2}},
+		Rules: []Rule{
+			{ID: "first", Group: "green", OrgName: "^acme$"},
+			{ID: "second", Group: "red", OrgName: "^acme$"},
+			{ID: "pinned", Group: "red", SpaceGuids: []string{"guid-1"}, Priority: 10},
+		},
+	})
+
+	for _, tc := range []struct {
+		space SpaceInfo
+		group string
+	}{
+		{SpaceInfo{Guid: "guid-1", OrgName: "acme"}, "red"},
+		{SpaceInfo{Guid: "guid-2", OrgName: "acme"}, "green"},
+		{SpaceInfo{Guid: "guid-3", OrgName: "acme-labs"}, "blue"},
+	} {
+		if got := MatchRules(config.Rules, config.DefaultGroup, tc.space); got != tc.group {
+			t.Errorf("space %+v: got %s, want %s", tc.space, got, tc.group)
+		}
+	}
+}
+
+func TestRuleLabelsAndAnnotations(t *testing.T) {
+	config := validConfig(t, Config{
+		DefaultGroup: "blue",
+		Groups:       []Group{{Name: "blue", PoolID: 0}, {Name: "red", PoolID: 1}},
+		Rules: []Rule{
+			{Group: "red", Labels: map[string]string{"env": "^prod"}, Annotations: map[string]string{"tier": "^(gold|silver)$"}},
+		},
+	})
+
+	for _, tc := range []struct {
+		space SpaceInfo
+		group string
+	}{
+		{SpaceInfo{Labels: map[string]string{"env": "production"}, Annotations: map[string]string{"tier": "gold"}}, "red"},
+		{SpaceInfo{Labels: map[string]string{"env": "production"}, Annotations: map[string]string{"tier": "bronze"}}, "blue"},
+		{SpaceInfo{Labels: map[string]string{"env": "production"}}, "blue"},
+		{SpaceInfo{Annotations: map[string]string{"tier": "gold"}}, "blue"},
+	} {
+		if got := MatchRules(config.Rules, config.DefaultGroup, tc.space); got != tc.group {
+			t.Errorf("space %+v: got %s, want %s", tc.space, got, tc.group)
+		}
+	}
+}
+
+func TestExplainRules(t *testing.T) {
+	config := validConfig(t, Config{
+		DefaultGroup: "blue",
+		Groups:       []Group{{Name: "blue", PoolID: 0}, {Name: "red", PoolID: 1}},
+		Rules: []Rule{
+			{ID: "prod", Group: "red", SpaceName: "prod", Priority: 1},
+			{ID: "acme", Group: "red", OrgName: "^acme$"},
+		},
+	})
+
+	explanation := ExplainRules(config.Rules, config.DefaultGroup, SpaceInfo{Name: "dev", OrgName: "acme"})
+	if explanation.Group != "red" || explanation.Rule != "acme" || explanation.Default {
+		t.Errorf("unexpected explanation %+v", explanation)
+	}
+
+	var evaluated []string
+	for _, result := range explanation.Evaluated {
+		evaluated = append(evaluated, result.ID)
+	}
+	if !reflect.DeepEqual(evaluated, []string{"prod", "acme"}) {
+		t.Errorf("evaluated %v, want prod then acme", evaluated)
+	}
+	if explanation.Evaluated[0].Matched || !reflect.DeepEqual(explanation.Evaluated[0].Reasons, []string{`space_name "dev" does not match "prod"`}) {
+		t.Errorf("unexpected result %+v", explanation.Evaluated[0])
+	}
+
+	explanation = ExplainRules(config.Rules, config.DefaultGroup, SpaceInfo{Name: "dev", OrgName: "other"})
+	if explanation.Group != "blue" || !explanation.Default {
+		t.Errorf("unexpected explanation %+v", explanation)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	config := Config{
+		DefaultGroup: "green",
+		Groups: []Group{
+			{Name: "blue", PoolID: 0, PortRanges: []string{"60000/70000"}},
+			{Name: "blue", PoolID: 0},
+		},
+		Rules: []Rule{
+			{Group: "red", SpaceName: "("},
+			{Group: "blue"},
+		},
+	}
+
+	err, ok := config.Validate().(ConfigError)
+	if !ok {
+		t.Fatalf("got %v, want a ConfigError", err)
+	}
+
+	want := []string{
+		`groups[0]: invalid port range "60000/70000": out of bounds`,
+		`groups[1]: duplicate name "blue"`,
+		`groups[1]: pool_id 0 already used by "blue"`,
+		`default_group: unknown group "green"`,
+		`rules[0]: unknown group "red"`,
+		"rules[0]: space_name: error parsing regexp: missing closing ): `(`",
+		"rules[1]: no space_name, org_name, space_guids, labels or annotations",
+	}
+	if !reflect.DeepEqual(err.Errors, want) {
+		t.Errorf("errors:\n%q\nwant:\n%q", err.Errors, want)
+	}
+
+	if config.Rules[1].ID != "config-1" {
+		t.Errorf("rule id %q, want config-1", config.Rules[1].ID)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+var readinessTimeout = flag.Duration(
+	"readinessTimeout",
+	5*time.Second,
+	"how long each /readyz check may take before it counts as failed",
+)
+
+// HealthChecker is implemented by backend drivers that can tell whether the
+// system they drive is reachable. Drivers without it are assumed healthy.
+type HealthChecker interface {
+	Healthy() error
+}
+
+type (
+	Readiness = policyclient.Readiness
+	Check     = policyclient.Check
+)
+
+// healthz only says the process is serving.
+func (b *broker) healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz runs every check concurrently and answers 503 unless all pass. The
+// result of each check, which can carry Cloud Controller and backend error
+// messages, is logged, and only shown to authenticated callers.
+func (b *broker) readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	readiness := b.readiness(*readinessTimeout)
+
+	status := http.StatusOK
+	if !readiness.Ready() {
+		status = http.StatusServiceUnavailable
+		requestLogger(r).Info("not-ready", lager.Data{"checks": readiness.Checks})
+	}
+
+	if principal(r) == "" {
+		readiness = Readiness{Status: readiness.Status}
+	}
+
+	writeJSON(w, status, readiness)
+}
+
+func (b *broker) readiness(timeout time.Duration) Readiness {
+	checks := map[string]func() error{
+		"store": func() error {
+			_, err := b.store.Groups()
+			return err
+		},
+		"cloud_controller": b.cache.directory.Ping,
+		"backend": func() error {
+			if checker, ok := b.backend.(HealthChecker); ok {
+				return checker.Healthy()
+			}
+			return nil
+		},
+	}
+
+	readiness := Readiness{Status: policyclient.StatusReady, Checks: make(map[string]Check, len(checks))}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+
+			result := Check{Healthy: true}
+			if err := withTimeout(timeout, check); err != nil {
+				result = Check{Healthy: false, Error: err.Error()}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			readiness.Checks[name] = result
+			if !result.Healthy {
+				readiness.Status = policyclient.StatusNotReady
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return readiness
+}
+
+// withTimeout gives up waiting for check after timeout; the check itself
+// keeps running in the background until it returns.
+func withTimeout(timeout time.Duration, check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+type (
+	loggerKey    struct{}
+	requestIDKey struct{}
+)
+
+// withRequestLogging gives every request a session tagged with the request
+// ID garden sent, or a new one, and logs how it was answered. Handlers get
+// the session with requestLogger.
+func withRequestLogging(logger lager.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(policyclient.RequestIDHeader)
+		if requestID == "" {
+			requestID = newID()
+		}
+
+		w.Header().Set(policyclient.RequestIDHeader, requestID)
+
+		session := logger.Session("request", lager.Data{
+			"request-id": requestID,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"query":      r.URL.RawQuery,
+		})
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+
+		session.Debug("serving")
+		ctx := context.WithValue(r.Context(), loggerKey{}, session)
+		ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+		data := lager.Data{"status": recorder.status, "duration": time.Since(started).String()}
+		switch {
+		case recorder.status >= http.StatusInternalServerError:
+			session.Error("served", recorder.err, data)
+		case recorder.err != nil:
+			data["error"] = recorder.err.Error()
+			session.Info("served", data)
+		default:
+			session.Info("served", data)
+		}
+	})
+}
+
+// requestLogger returns the request's session.
+func requestLogger(r *http.Request) lager.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(lager.Logger); ok {
+		return logger
+	}
+
+	return lager.NewLogger("policy-broker")
+}
+
+// requestID returns the ID withRequestLogging tagged the request with.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// responseRecorder remembers the status and, via writeError, the error a
+// request was answered with.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
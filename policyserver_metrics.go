@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The broker's metrics, served on /metrics in the Prometheus text exposition
+// format. Gauges that can be derived from the store are computed on scrape.
+var (
+	httpRequests = newCounter("policy_broker_http_requests_total",
+		"HTTP requests served, by route, method and status code.", "route", "method", "status")
+	httpDuration = newHistogram("policy_broker_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route.", "route")
+
+	ccRequests = newCounter("policy_broker_cc_requests_total",
+		"Cloud Controller calls, by operation and result.", "operation", "result")
+	ccDuration = newHistogram("policy_broker_cc_request_duration_seconds",
+		"Cloud Controller call latency, by operation.", "operation")
+
+	spaceCacheLookups = newCounter("policy_broker_space_cache_lookups_total",
+		"Space cache lookups, by result (hit, miss or stale).", "result")
+
+	backendRequests = newCounter("policy_broker_backend_requests_total",
+		"Policy backend calls, by operation.", "operation")
+	backendErrors = newCounter("policy_broker_backend_errors_total",
+		"Failed policy backend calls, by operation.", "operation")
+
+	webhookDeliveries = newCounter("policy_broker_webhook_delivery_attempts_total",
+		"Webhook delivery attempts, by result (delivered, failed or dead).", "result")
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	collectorsMutex sync.Mutex
+	collectors      []collector
+)
+
+func register(c collector) {
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+
+	collectors = append(collectors, c)
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (f metricFamily) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, kind)
+}
+
+// labelKey joins label values so they can key a map; \xff cannot appear in
+// valid UTF-8.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (f metricFamily) labelPairs(key string, extra ...string) string {
+	var values []string
+	if len(f.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+
+	pairs := make([]string, 0, len(values)+1)
+	for i, label := range f.labels {
+		pairs = append(pairs, label+"="+strconv.Quote(values[i]))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+"="+strconv.Quote(extra[1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counter struct {
+	metricFamily
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{
+		metricFamily: metricFamily{name: name, help: help, labels: labels},
+		values:       make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+func (c *counter) Inc(labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", c.name, len(c.labels), len(labelValues))) // should never happen..
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	metricFamily
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	h := &histogram{
+		metricFamily: metricFamily{name: name, help: help, labels: labels},
+		buckets:      defaultBuckets,
+		series:       make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+func (h *histogram) Observe(duration time.Duration, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", h.name, len(h.labels), len(labelValues))) // should never happen..
+	}
+
+	value := duration.Seconds()
+	key := labelKey(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, found := h.series[key]
+	if !found {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h.header(w, "histogram")
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), series.count)
+	}
+}
+
+// writeGauge writes a gauge computed at scrape time.
+func writeGauge(w io.Writer, name, help, label string, values map[string]float64) {
+	family := metricFamily{name: name, help: help, labels: []string{label}}
+
+	family.header(w, "gauge")
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, family.labelPairs(key), formatFloat(values[key]))
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (b *broker) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	endpointsPerGroup, spacesPerGroup, err := b.groupSizes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	collectorsMutex.Lock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+	collectorsMutex.Unlock()
+
+	writeGauge(w, "policy_broker_endpoints", "Registered endpoints, by group.", "group", endpointsPerGroup)
+	writeGauge(w, "policy_broker_spaces", "Known spaces classified into each group.", "group", spacesPerGroup)
+}
+
+// groupSizes only classifies spaces already in the cache, a scrape never
+// calls Cloud Controller.
+func (b *broker) groupSizes() (map[string]float64, map[string]float64, error) {
+	groups, err := b.store.Groups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	endpoints, err := b.store.Endpoints()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules, err := b.store.Rules()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overrides, err := b.store.Overrides()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overridden := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		overridden[override.Space] = override.Group
+	}
+
+	endpointsPerGroup := make(map[string]float64, len(groups))
+	spacesPerGroup := make(map[string]float64, len(groups))
+	for _, group := range groups {
+		endpointsPerGroup[group.Name] = 0
+		spacesPerGroup[group.Name] = 0
+	}
+
+	for _, endpoint := range endpoints {
+		endpointsPerGroup[endpoint.Group]++
+	}
+
+	defaultGroup := b.config.Get().DefaultGroup
+	for _, space := range b.cache.Cached() {
+		if group, found := overridden[space.Guid]; found {
+			spacesPerGroup[group]++
+			continue
+		}
+		spacesPerGroup[MatchRules(rules, defaultGroup, space)]++
+	}
+
+	return endpointsPerGroup, spacesPerGroup, nil
+}
+
+// instrument counts and times requests by the mux pattern they matched, so
+// that the route label stays bounded.
+func instrument(mux *http.ServeMux, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		recorder, ok := w.(*responseRecorder)
+		if !ok {
+			recorder = &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		}
+
+		started := time.Now()
+		handler.ServeHTTP(recorder, r)
+
+		httpRequests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		httpDuration.Observe(time.Since(started), route)
+	})
+}
+
+// instrumentedDirectory records Cloud Controller calls.
+type instrumentedDirectory struct {
+	directory SpaceDirectory
+}
+
+func (d instrumentedDirectory) Spaces() ([]SpaceInfo, error) {
+	started := time.Now()
+	spaces, err := d.directory.Spaces()
+	observeCC("list-spaces", started, err)
+	return spaces, err
+}
+
+func (d instrumentedDirectory) Space(guid string) (SpaceInfo, error) {
+	started := time.Now()
+	space, err := d.directory.Space(guid)
+	if _, ok := err.(SpaceNotFoundError); ok {
+		observeCC("get-space", started, nil)
+	} else {
+		observeCC("get-space", started, err)
+	}
+	return space, err
+}
+
+func (d instrumentedDirectory) Ping() error {
+	started := time.Now()
+	err := d.directory.Ping()
+	observeCC("ping", started, err)
+	return err
+}
+
+func observeCC(operation string, started time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	ccRequests.Inc(operation, result)
+	ccDuration.Observe(time.Since(started), operation)
+}
+
+// instrumentedBackend counts backend calls and their failures.
+type instrumentedBackend struct {
+	backend PolicyBackend
+}
+
+func (b instrumentedBackend) CreatePolicy(name string) error {
+	return observeBackend("create-policy", b.backend.CreatePolicy(name))
+}
+
+func (b instrumentedBackend) CreateEndpointGroup(name string, policy string) error {
+	return observeBackend("create-endpoint-group", b.backend.CreateEndpointGroup(name, policy))
+}
+
+func (b instrumentedBackend) DeleteEndpointGroup(name string) error {
+	return observeBackend("delete-endpoint-group", b.backend.DeleteEndpointGroup(name))
+}
+
+func (b instrumentedBackend) AddEndpoint(group string, address string) error {
+	return observeBackend("add-endpoint", b.backend.AddEndpoint(group, address))
+}
+
+func (b instrumentedBackend) RemoveEndpoint(group string, address string) error {
+	return observeBackend("remove-endpoint", b.backend.RemoveEndpoint(group, address))
+}
+
+func (b instrumentedBackend) Healthy() error {
+	if checker, ok := b.backend.(HealthChecker); ok {
+		return checker.Healthy()
+	}
+	return nil
+}
+
+func observeBackend(operation string, err error) error {
+	backendRequests.Inc(operation)
+	if err != nil {
+		backendErrors.Inc(operation)
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Override pins a space to a group regardless of the rules. SetBy is the
+// identity the request authenticated as, not something the caller claims.
+type Override struct {
+	Space  string    `json:"space"`
+	Group  string    `json:"group"`
+	Reason string    `json:"reason,omitempty"`
+	SetBy  string    `json:"set_by"`
+	SetAt  time.Time `json:"set_at"`
+}
+
+func (b *broker) overrides(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	overrides, err := b.store.Overrides()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+
+	filtered := []Override{}
+	for _, override := range overrides {
+		if group == "" || override.Group == group {
+			filtered = append(filtered, override)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+// spaceGroup serves /v1/spaces/{guid}/group.
+func (b *broker) spaceGroup(w http.ResponseWriter, r *http.Request, guid string) {
+	switch r.Method {
+	case "GET":
+		override, err := b.store.Override(guid)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, override)
+
+	case "PUT":
+		var override Override
+		if err := decodeJSON(r, &override); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if override.Space == "" {
+			override.Space = guid
+		}
+
+		if override.Space != guid {
+			writeError(w, InvalidRequestError{"space cannot be changed"})
+			return
+		}
+
+		actor := requestActor(r)
+		override.SetBy = actor.Name
+		override.SetAt = time.Now().UTC()
+
+		if err := b.putOverride(requestLogger(r), actor, override); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, override)
+
+	case "DELETE":
+		if err := b.deleteOverride(requestLogger(r), requestActor(r), guid); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+func (b *broker) putOverride(logger lager.Logger, actor Actor, override Override) error {
+	if override.Group == "" {
+		return InvalidRequestError{"group is required"}
+	}
+
+	if err := b.storeOverride(logger, actor, override); err != nil {
+		return err
+	}
+
+	logger.Info("set-override", lager.Data{"space": override.Space, "group": override.Group, "set-by": override.SetBy})
+
+	return b.regroupSpace(logger, actor, override.Space)
+}
+
+func (b *broker) storeOverride(logger lager.Logger, actor Actor, override Override) error {
+	b.apiMutex.Lock()
+	defer b.apiMutex.Unlock()
+
+	if _, err := b.store.Group(override.Group); err != nil {
+		if _, ok := err.(GroupNotFoundError); ok {
+			return InvalidRequestError{fmt.Sprintf("group %s does not exist", override.Group)}
+		}
+		return err
+	}
+
+	var before interface{}
+	if previous, err := b.store.Override(override.Space); err == nil {
+		before = previous
+	}
+
+	if err := b.store.PutOverride(override); err != nil {
+		return err
+	}
+
+	b.record(logger, actor, AuditEvent{Action: "set-override", Space: override.Space, Group: override.Group, Before: before, After: override})
+
+	return nil
+}
+
+func (b *broker) deleteOverride(logger lager.Logger, actor Actor, space string) error {
+	b.apiMutex.Lock()
+	previous, err := b.store.Override(space)
+	if err == nil {
+		err = b.store.DeleteOverride(space)
+	}
+	b.apiMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	logger.Info("deleted-override", lager.Data{"space": space, "deleted-by": actor.Name})
+	b.record(logger, actor, AuditEvent{Action: "delete-override", Space: space, Group: previous.Group, Before: previous})
+
+	return b.regroupSpace(logger, actor, space)
+}
+
+// regroupSpace re-registers the space's endpoints so that they move to the
+// group the space now classifies into.
+func (b *broker) regroupSpace(logger lager.Logger, actor Actor, space string) error {
+	endpoints, err := b.store.Endpoints()
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.Space != space {
+			continue
+		}
+
+		if _, err := b.registerEndpoint(logger, actor, space, endpoint.Address); err != nil {
+			return fmt.Errorf("moving endpoint %s: %s", endpoint.Address, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+	"code.cloudfoundry.org/lager"
+)
+
+func TestOverrideTakesPrecedenceOverRules(t *testing.T) {
+	b, server, backend := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	logger := lager.NewLogger("test")
+	if _, err := b.registerEndpoint(logger, systemActor, "dev-guid", "10.0.0.1:60000"); err != nil {
+		t.Fatal(err)
+	}
+
+	var override Override
+	if status := apiRequest(t, server, "PUT", "/v1/spaces/dev-guid/group", Override{Group: "red", Reason: "pinned"}, &override); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if override.Space != "dev-guid" || override.SetBy != "anonymous" || override.SetAt.IsZero() {
+		t.Errorf("unexpected override %+v", override)
+	}
+
+	// GetPolicy and the policy garden asks for both go by the override
+	if got := b.GetPolicy(logger, "dev-guid"); got != "red" {
+		t.Errorf("GetPolicy %s, want red", got)
+	}
+
+	client, err := policyclient.New(policyclient.Config{URL: server.URL, Timeout: time.Second}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := client.SpacePolicy(context.Background(), "dev-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Group != "red" {
+		t.Errorf("policy %+v, want red", policy)
+	}
+
+	// the space's endpoints move along
+	if got, want := backend.Endpoints("red"), []string{"10.0.0.1:60000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("red endpoints %v, want %v", got, want)
+	}
+	if got := backend.Endpoints("blue"); len(got) != 0 {
+		t.Errorf("blue endpoints %v, want none", got)
+	}
+
+	var overrides []Override
+	apiRequest(t, server, "GET", "/v1/overrides?group=red", nil, &overrides)
+	if len(overrides) != 1 || overrides[0].Space != "dev-guid" {
+		t.Errorf("overrides of red %+v", overrides)
+	}
+	apiRequest(t, server, "GET", "/v1/overrides?group=blue", nil, &overrides)
+	if len(overrides) != 0 {
+		t.Errorf("overrides of blue %+v, want none", overrides)
+	}
+
+	// deleting the override hands the space back to the rules
+	if status := apiRequest(t, server, "DELETE", "/v1/spaces/dev-guid/group", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("status %d", status)
+	}
+	if got := b.GetPolicy(logger, "dev-guid"); got != "blue" {
+		t.Errorf("GetPolicy %s, want blue", got)
+	}
+	if got, want := backend.Endpoints("blue"), []string{"10.0.0.1:60000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blue endpoints %v, want %v", got, want)
+	}
+	if status := apiRequest(t, server, "GET", "/v1/spaces/dev-guid/group", nil, nil); status != http.StatusNotFound {
+		t.Errorf("status %d, want the deleted override to be gone", status)
+	}
+}
+
+func TestOverrideIsValidated(t *testing.T) {
+	_, server, _ := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	for _, override := range []Override{
+		{},
+		{Group: "purple"},
+		{Space: "prod-guid", Group: "red"},
+	} {
+		if status := apiRequest(t, server, "PUT", "/v1/spaces/dev-guid/group", override, nil); status != http.StatusBadRequest {
+			t.Errorf("override %+v: status %d, want 400", override, status)
+		}
+	}
+}
+
+func TestOverridesPersist(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "store.json")
+
+	store, err := NewFileStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, server, _ := newTestBrokerWithStore(t, AuthConfig{}, store)
+	server.Start()
+
+	if status := apiRequest(t, server, "PUT", "/v1/spaces/dev-guid/group", Override{Group: "green", Reason: "pinned"}, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	reopened, err := NewFileStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	override, err := reopened.Override("dev-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override.Group != "green" || override.Reason != "pinned" || override.SetBy != "anonymous" {
+		t.Errorf("reopened override %+v", override)
+	}
+
+	if status := apiRequest(t, server, "DELETE", "/v1/spaces/dev-guid/group", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("status %d", status)
+	}
+
+	reopened, err = NewFileStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Override("dev-guid"); err != (OverrideNotFoundError{"dev-guid"}) {
+		t.Errorf("got %v, want the deleted override to stay deleted", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func (b *broker) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	var req ReconcileRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := b.reconcile(requestLogger(r), requestActor(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// reconcile makes the endpoints registered for req.Host match req.Endpoints.
+// Endpoints of other hosts are left alone. An endpoint whose space changed is
+// re-registered and reported as added.
+func (b *broker) reconcile(logger lager.Logger, actor Actor, req ReconcileRequest) (ReconcileResult, error) {
+	result := ReconcileResult{Added: []Endpoint{}, Removed: []Endpoint{}, DryRun: req.DryRun}
+
+	if req.Host == "" {
+		return result, InvalidRequestError{"host is required"}
+	}
+
+	desired := map[string]string{}
+	for _, endpoint := range req.Endpoints {
+		if endpoint.Space == "" || endpoint.Endpoint == "" {
+			return result, InvalidRequestError{"space and endpoint are required"}
+		}
+
+		if host, _, err := net.SplitHostPort(endpoint.Endpoint); err != nil || host != req.Host {
+			return result, InvalidRequestError{"endpoint not on host " + req.Host + ": " + endpoint.Endpoint}
+		}
+
+		desired[endpoint.Endpoint] = endpoint.Space
+	}
+
+	endpoints, err := b.store.Endpoints()
+	if err != nil {
+		return result, err
+	}
+
+	actual := map[string]Endpoint{}
+	for _, endpoint := range endpoints {
+		if host, _, err := net.SplitHostPort(endpoint.Address); err == nil && host == req.Host {
+			actual[endpoint.Address] = endpoint
+		}
+	}
+
+	for address, endpoint := range actual {
+		if _, found := desired[address]; found {
+			continue
+		}
+
+		if !req.DryRun {
+			_, err := b.deregisterEndpoint(logger, actor, address)
+			if _, ok := err.(EndpointNotFoundError); err != nil && !ok {
+				return result, err
+			}
+		}
+
+		result.Removed = append(result.Removed, endpoint)
+	}
+
+	for address, space := range desired {
+		endpoint := Endpoint{Space: space, Address: address, Group: b.GetPolicy(logger, space)}
+		if actual[address] == endpoint {
+			continue
+		}
+
+		if !req.DryRun {
+			endpoint, err = b.registerEndpoint(logger, actor, space, address)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		result.Added = append(result.Added, endpoint)
+	}
+
+	sort.Slice(result.Added, func(i, j int) bool { return result.Added[i].Address < result.Added[j].Address })
+	sort.Slice(result.Removed, func(i, j int) bool { return result.Removed[i].Address < result.Removed[j].Address })
+
+	logger.Info("reconciled", lager.Data{"host": req.Host, "dry-run": req.DryRun, "added": len(result.Added), "removed": len(result.Removed)})
+
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func addresses(endpoints []Endpoint) []string {
+	list := []string{}
+	for _, endpoint := range endpoints {
+		list = append(list, endpoint.Address)
+	}
+	return list
+}
+
+func TestReconcile(t *testing.T) {
+	b, server, backend := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	logger := lager.NewLogger("test")
+	for _, endpoint := range []SpaceGroup{
+		{Space: "dev-guid", Endpoint: "10.0.0.1:60000"},
+		{Space: "dev-guid", Endpoint: "10.0.0.1:60001"},
+		{Space: "dev-guid", Endpoint: "10.0.0.2:60000"},
+	} {
+		if _, err := b.registerEndpoint(logger, systemActor, endpoint.Space, endpoint.Endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 60000 moved to another space, 60001 is stale, 60002 was missed; the
+	// other host's endpoint is not part of the set
+	req := ReconcileRequest{
+		Host: "10.0.0.1",
+		Endpoints: []SpaceGroup{
+			{Space: "prod-guid", Endpoint: "10.0.0.1:60000"},
+			{Space: "dev-guid", Endpoint: "10.0.0.1:60002"},
+		},
+		DryRun: true,
+	}
+
+	var result ReconcileResult
+	if status := apiRequest(t, server, "POST", "/v1/reconcile", req, &result); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if got, want := addresses(result.Added), []string{"10.0.0.1:60000", "10.0.0.1:60002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run added %v, want %v", got, want)
+	}
+	if got, want := addresses(result.Removed), []string{"10.0.0.1:60001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run removed %v, want %v", got, want)
+	}
+	if !result.DryRun {
+		t.Error("expected the result to be marked as dry run")
+	}
+
+	// the dry run changed nothing
+	if got, want := backend.Endpoints("blue"), []string{"10.0.0.1:60000", "10.0.0.1:60001", "10.0.0.2:60000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blue endpoints after dry run %v, want %v", got, want)
+	}
+	if got := backend.Endpoints("red"); len(got) != 0 {
+		t.Errorf("red endpoints after dry run %v, want none", got)
+	}
+
+	req.DryRun = false
+	if status := apiRequest(t, server, "POST", "/v1/reconcile", req, &result); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if got, want := addresses(result.Removed), []string{"10.0.0.1:60001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed %v, want %v", got, want)
+	}
+
+	if got, want := backend.Endpoints("blue"), []string{"10.0.0.1:60002", "10.0.0.2:60000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blue endpoints %v, want %v", got, want)
+	}
+	if got, want := backend.Endpoints("red"), []string{"10.0.0.1:60000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("red endpoints %v, want %v", got, want)
+	}
+	if _, err := b.store.Endpoint("10.0.0.1:60001"); err != (EndpointNotFoundError{"10.0.0.1:60001"}) {
+		t.Errorf("got %v, want the stale endpoint to be gone from the store", err)
+	}
+
+	// now in sync
+	if status := apiRequest(t, server, "POST", "/v1/reconcile", req, &result); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if len(result.Added) != 0 || len(result.Removed) != 0 {
+		t.Errorf("got %+v, want nothing left to reconcile", result)
+	}
+}
+
+func TestReconcileIsValidated(t *testing.T) {
+	_, server, _ := newTestBroker(t, AuthConfig{})
+	server.Start()
+
+	for _, req := range []ReconcileRequest{
+		{Endpoints: []SpaceGroup{}},
+		{Host: "10.0.0.1", Endpoints: []SpaceGroup{{Space: "dev-guid"}}},
+		{Host: "10.0.0.1", Endpoints: []SpaceGroup{{Space: "dev-guid", Endpoint: "10.0.0.2:60000"}}},
+	} {
+		if status := apiRequest(t, server, "POST", "/v1/reconcile", req, nil); status != http.StatusBadRequest {
+			t.Errorf("request %+v: status %d, want 400", req, status)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"golang.org/x/sync/singleflight"
+)
+
+// SpaceDirectory is where spaces are looked up, normally Cloud Controller.
+type SpaceDirectory interface {
+	Spaces() ([]SpaceInfo, error)
+	// Space returns SpaceNotFoundError when there is no such space.
+	Space(guid string) (SpaceInfo, error)
+	// Ping checks that the directory is reachable.
+	Ping() error
+}
+
+type cfSpaceDirectory struct {
+	client *cfclient.Client
+}
+
+func NewCFSpaceDirectory(client *cfclient.Client) SpaceDirectory {
+	return &cfSpaceDirectory{client: client}
+}
+
+// Spaces uses the v3 API, which returns labels and annotations with the
+// listing.
+func (d *cfSpaceDirectory) Spaces() ([]SpaceInfo, error) {
+	orgs, err := d.client.ListV3OrganizationsByQuery(nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing orgs: %s", err)
+	}
+
+	orgNames := make(map[string]string)
+	for _, org := range orgs {
+		orgNames[org.GUID] = org.Name
+	}
+
+	spaces, err := d.client.ListV3SpacesByQuery(nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing spaces: %s", err)
+	}
+
+	infos := make([]SpaceInfo, 0, len(spaces))
+	for _, s := range spaces {
+		infos = append(infos, SpaceInfo{
+			Guid:        s.GUID,
+			Name:        s.Name,
+			OrgName:     orgNames[s.Relationships["organization"].Data.GUID],
+			Labels:      s.Metadata.Labels,
+			Annotations: s.Metadata.Annotations,
+		})
+	}
+
+	return infos, nil
+}
+
+func (d *cfSpaceDirectory) Space(guid string) (SpaceInfo, error) {
+	s, err := d.client.GetSpaceByGuid(guid)
+	if err != nil {
+		if cfclient.IsSpaceNotFoundError(err) {
+			return SpaceInfo{}, SpaceNotFoundError{guid}
+		}
+		return SpaceInfo{}, fmt.Errorf("getting space: %s", err)
+	}
+
+	space := SpaceInfo{Guid: s.Guid, Name: s.Name}
+
+	org, err := d.client.GetOrgByGuid(s.OrganizationGuid)
+	if err != nil {
+		return SpaceInfo{}, fmt.Errorf("getting org: %s", err)
+	}
+	space.OrgName = org.Name
+
+	metadata, err := d.client.SpaceMetadata(guid)
+	if err != nil {
+		return SpaceInfo{}, fmt.Errorf("getting space metadata: %s", err)
+	}
+	space.Labels = stringValues(metadata.Labels)
+	space.Annotations = stringValues(metadata.Annotations)
+
+	return space, nil
+}
+
+// stringValues drops the null values CC uses for removed metadata.
+func stringValues(metadata map[string]interface{}) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		if value != nil {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	return values
+}
+
+// Ping checks that Cloud Controller answers and that the broker can still
+// get a token.
+func (d *cfSpaceDirectory) Ping() error {
+	if _, err := d.client.GetInfo(); err != nil {
+		return fmt.Errorf("getting info: %s", err)
+	}
+
+	if _, err := d.client.GetToken(); err != nil {
+		return fmt.Errorf("getting token: %s", err)
+	}
+
+	return nil
+}
+
+type cachedSpace struct {
+	space   SpaceInfo
+	found   bool
+	expires time.Time
+}
+
+// spaceCache caches the directory for ttl. Concurrent misses for the same
+// space share a single directory call, and when the directory fails a stale
+// entry is served rather than nothing.
+type spaceCache struct {
+	directory SpaceDirectory
+	ttl       time.Duration
+	logger    lager.Logger
+
+	mutex    sync.RWMutex
+	entries  map[string]cachedSpace
+	list     []SpaceInfo
+	listedAt time.Time
+
+	flight singleflight.Group
+}
+
+func NewSpaceCache(directory SpaceDirectory, ttl time.Duration, logger lager.Logger) *spaceCache {
+	return &spaceCache{
+		directory: directory,
+		ttl:       ttl,
+		logger:    logger.Session("space-cache"),
+		entries:   make(map[string]cachedSpace),
+	}
+}
+
+func (c *spaceCache) Space(guid string) (SpaceInfo, error) {
+	c.mutex.RLock()
+	entry, cached := c.entries[guid]
+	c.mutex.RUnlock()
+
+	if cached && time.Now().Before(entry.expires) {
+		spaceCacheLookups.Inc("hit")
+		return entry.result(guid)
+	}
+
+	spaceCacheLookups.Inc("miss")
+
+	v, err, _ := c.flight.Do("space:"+guid, func() (interface{}, error) {
+		space, err := c.directory.Space(guid)
+
+		switch err.(type) {
+		case nil:
+			return c.put(cachedSpace{space: space, found: true}, guid), nil
+		case SpaceNotFoundError:
+			return c.put(cachedSpace{found: false}, guid), nil
+		default:
+			return nil, err
+		}
+	})
+	if err != nil {
+		if cached {
+			c.logger.Error("serving-stale-space", err, lager.Data{"space": guid})
+			spaceCacheLookups.Inc("stale")
+			return entry.result(guid)
+		}
+		return SpaceInfo{}, err
+	}
+
+	return v.(cachedSpace).result(guid)
+}
+
+func (c *spaceCache) Spaces() ([]SpaceInfo, error) {
+	c.mutex.RLock()
+	list, listedAt := c.list, c.listedAt
+	c.mutex.RUnlock()
+
+	if list != nil && time.Since(listedAt) < c.ttl {
+		return list, nil
+	}
+
+	if err := c.Refresh(); err != nil {
+		if list != nil {
+			c.logger.Error("serving-stale-spaces", err)
+			return list, nil
+		}
+		return nil, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.list, nil
+}
+
+// Cached returns the last full listing without calling the directory.
+func (c *spaceCache) Cached() []SpaceInfo {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.list
+}
+
+// Refresh replaces the whole cache with a fresh listing from the directory.
+func (c *spaceCache) Refresh() error {
+	_, err, _ := c.flight.Do("spaces", func() (interface{}, error) {
+		spaces, err := c.directory.Spaces()
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		entries := make(map[string]cachedSpace, len(spaces))
+		for _, space := range spaces {
+			entries[space.Guid] = cachedSpace{space: space, found: true, expires: now.Add(c.ttl)}
+		}
+
+		c.mutex.Lock()
+		c.entries = entries
+		c.list = spaces
+		c.listedAt = now
+		c.mutex.Unlock()
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// Run refreshes the cache every interval until stop is closed.
+func (c *spaceCache) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Refresh(); err != nil {
+			c.logger.Error("failed-to-refresh", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *spaceCache) put(entry cachedSpace, guid string) cachedSpace {
+	entry.expires = time.Now().Add(c.ttl)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[guid] = entry
+
+	return entry
+}
+
+func (e cachedSpace) result(guid string) (SpaceInfo, error) {
+	if !e.found {
+		return SpaceInfo{}, SpaceNotFoundError{guid}
+	}
+
+	return e.space, nil
+}
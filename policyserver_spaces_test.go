@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// countingDirectory counts the lookups that reach it. While block is set,
+// Space waits for it to be closed.
+type countingDirectory struct {
+	mutex  sync.Mutex
+	spaces map[string]SpaceInfo
+	err    error
+	calls  int
+	block  chan struct{}
+}
+
+func (d *countingDirectory) Spaces() ([]SpaceInfo, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	spaces := []SpaceInfo{}
+	for _, space := range d.spaces {
+		spaces = append(spaces, space)
+	}
+	return spaces, nil
+}
+
+func (d *countingDirectory) Space(guid string) (SpaceInfo, error) {
+	d.mutex.Lock()
+	d.calls++
+	block := d.block
+	d.mutex.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.err != nil {
+		return SpaceInfo{}, d.err
+	}
+
+	space, found := d.spaces[guid]
+	if !found {
+		return SpaceInfo{}, SpaceNotFoundError{guid}
+	}
+	return space, nil
+}
+
+func (d *countingDirectory) Ping() error {
+	return nil
+}
+
+func (d *countingDirectory) set(f func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	f()
+}
+
+func (d *countingDirectory) lookups() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.calls
+}
+
+func newCountingDirectory() *countingDirectory {
+	return &countingDirectory{spaces: map[string]SpaceInfo{
+		"dev-guid": {Guid: "dev-guid", Name: "my-dev", OrgName: "org"},
+	}}
+}
+
+func TestSpaceCacheExpires(t *testing.T) {
+	directory := newCountingDirectory()
+	cache := NewSpaceCache(directory, 50*time.Millisecond, lager.NewLogger("test"))
+
+	for i := 0; i < 2; i++ {
+		if space, err := cache.Space("dev-guid"); err != nil || space.Name != "my-dev" {
+			t.Fatalf("got %+v, %v", space, err)
+		}
+		if _, err := cache.Space("missing"); err != (SpaceNotFoundError{"missing"}) {
+			t.Fatalf("got %v, want the space not to be found", err)
+		}
+	}
+	if got := directory.lookups(); got != 2 {
+		t.Errorf("%d lookups, want spaces and missing spaces to be cached", got)
+	}
+
+	directory.set(func() { directory.spaces["dev-guid"] = SpaceInfo{Guid: "dev-guid", Name: "renamed"} })
+	time.Sleep(60 * time.Millisecond)
+
+	if space, err := cache.Space("dev-guid"); err != nil || space.Name != "renamed" {
+		t.Errorf("got %+v, %v, want the expired entry to be looked up again", space, err)
+	}
+	if got := directory.lookups(); got != 3 {
+		t.Errorf("%d lookups, want 3", got)
+	}
+}
+
+func TestSpaceCacheCollapsesConcurrentMisses(t *testing.T) {
+	directory := newCountingDirectory()
+	directory.block = make(chan struct{})
+	cache := NewSpaceCache(directory, time.Minute, lager.NewLogger("test"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if space, err := cache.Space("dev-guid"); err != nil || space.Name != "my-dev" {
+				t.Errorf("got %+v, %v", space, err)
+			}
+		}()
+	}
+
+	// lookups arriving after the first one either join it or, once it is
+	// done, hit the cache
+	time.Sleep(20 * time.Millisecond)
+	close(directory.block)
+	wg.Wait()
+
+	if got := directory.lookups(); got != 1 {
+		t.Errorf("%d lookups, want 1", got)
+	}
+}
+
+func TestSpaceCacheServesStaleEntries(t *testing.T) {
+	directory := newCountingDirectory()
+	cache := NewSpaceCache(directory, time.Millisecond, lager.NewLogger("test"))
+
+	if _, err := cache.Space("dev-guid"); err != nil {
+		t.Fatal(err)
+	}
+	spaces, err := cache.Spaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory.set(func() { directory.err = errors.New("cloud controller is unreachable") })
+	time.Sleep(5 * time.Millisecond)
+
+	if space, err := cache.Space("dev-guid"); err != nil || space.Name != "my-dev" {
+		t.Errorf("got %+v, %v, want the stale entry", space, err)
+	}
+	if stale, err := cache.Spaces(); err != nil || !reflect.DeepEqual(stale, spaces) {
+		t.Errorf("got %+v, %v, want the stale listing", stale, err)
+	}
+
+	// with nothing cached, the failure is returned
+	if _, err := cache.Space("prod-guid"); err == nil || err == (SpaceNotFoundError{"prod-guid"}) {
+		t.Errorf("got %v, want the directory's failure", err)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/garden-linux/policyclient"
+)
+
+// The wire types are shared with garden through policyclient.
+type (
+	Group       = policyclient.Group
+	Endpoint    = policyclient.Endpoint
+	SpaceGroup  = policyclient.SpaceGroup
+	SpacePolicy = policyclient.SpacePolicy
+
+	ReconcileRequest = policyclient.ReconcileRequest
+	ReconcileResult  = policyclient.ReconcileResult
+)
+
+type Store interface {
+	Groups() ([]Group, error)
+	Group(name string) (Group, error)
+	PutGroup(group Group) error
+	DeleteGroup(name string) error
+
+	Endpoints() ([]Endpoint, error)
+	Endpoint(address string) (Endpoint, error)
+	AddEndpoint(endpoint Endpoint) error
+	RemoveEndpoint(address string) error
+
+	Rules() ([]Rule, error)
+	Rule(id string) (Rule, error)
+	PutRule(rule Rule) error
+	DeleteRule(id string) error
+	SetRules(rules []Rule) error
+
+	// ReplaceConfig makes groups and rules the only ones, in a single write.
+	ReplaceConfig(groups []Group, rules []Rule) error
+
+	Overrides() ([]Override, error)
+	Override(space string) (Override, error)
+	PutOverride(override Override) error
+	DeleteOverride(space string) error
+
+	Webhooks() ([]Webhook, error)
+	Webhook(id string) (Webhook, error)
+	PutWebhook(webhook Webhook) error
+	DeleteWebhook(id string) error
+
+	Close() error
+}
+
+type GroupNotFoundError struct {
+	Name string
+}
+
+func (err GroupNotFoundError) Error() string {
+	return fmt.Sprintf("group does not exist: %s", err.Name)
+}
+
+type EndpointNotFoundError struct {
+	Address string
+}
+
+func (err EndpointNotFoundError) Error() string {
+	return fmt.Sprintf("endpoint does not exist: %s", err.Address)
+}
+
+type RuleNotFoundError struct {
+	ID string
+}
+
+func (err RuleNotFoundError) Error() string {
+	return fmt.Sprintf("rule does not exist: %s", err.ID)
+}
+
+type OverrideNotFoundError struct {
+	Space string
+}
+
+func (err OverrideNotFoundError) Error() string {
+	return fmt.Sprintf("space has no override: %s", err.Space)
+}
+
+type WebhookNotFoundError struct {
+	ID string
+}
+
+func (err WebhookNotFoundError) Error() string {
+	return fmt.Sprintf("webhook does not exist: %s", err.ID)
+}
+
+type storeData struct {
+	Groups    map[string]Group    `json:"groups"`
+	Endpoints map[string]Endpoint `json:"endpoints"`
+	Rules     []Rule              `json:"rules"`
+	Overrides map[string]Override `json:"overrides"`
+	Webhooks  map[string]Webhook  `json:"webhooks"`
+}
+
+func newStoreData() storeData {
+	return storeData{
+		Groups:    make(map[string]Group),
+		Endpoints: make(map[string]Endpoint),
+		Overrides: make(map[string]Override),
+		Webhooks:  make(map[string]Webhook),
+	}
+}
+
+// memoryStore keeps everything in memory. When persist is set it is called
+// with the store locked after every mutation, and a failure rolls the
+// mutation back.
+type memoryStore struct {
+	mutex sync.RWMutex
+	data  storeData
+
+	persist func(storeData) error
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{data: newStoreData()}
+}
+
+// NewFileStore returns a store backed by a JSON file at filePath. The file is
+// rewritten atomically on every mutation so that a crash leaves either the
+// old or the new contents on disk.
+func NewFileStore(filePath string) (Store, error) {
+	data := newStoreData()
+
+	contents, err := ioutil.ReadFile(filePath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("reading store file: %s", err)
+	default:
+		if err := json.Unmarshal(contents, &data); err != nil {
+			return nil, fmt.Errorf("parsing store file: %s", err)
+		}
+		if data.Groups == nil {
+			data.Groups = make(map[string]Group)
+		}
+		if data.Endpoints == nil {
+			data.Endpoints = make(map[string]Endpoint)
+		}
+		if data.Overrides == nil {
+			data.Overrides = make(map[string]Override)
+		}
+		if data.Webhooks == nil {
+			data.Webhooks = make(map[string]Webhook)
+		}
+		for i := range data.Rules {
+			if err := data.Rules[i].compile(); err != nil {
+				return nil, fmt.Errorf("parsing store file: rule %s: %s", data.Rules[i].ID, err)
+			}
+		}
+	}
+
+	return &memoryStore{
+		data: data,
+		persist: func(data storeData) error {
+			return writeFileAtomic(filePath, data)
+		},
+	}, nil
+}
+
+func writeFileAtomic(filePath string, v interface{}) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary store file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := json.NewEncoder(tmpFile).Encode(v); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("writing store file: %s", err)
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("syncing store file: %s", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing store file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("renaming store file: %s", err)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Groups() ([]Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := make([]Group, 0, len(s.data.Groups))
+	for _, group := range s.data.Groups {
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	return groups, nil
+}
+
+func (s *memoryStore) Group(name string) (Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	group, found := s.data.Groups[name]
+	if !found {
+		return Group{}, GroupNotFoundError{name}
+	}
+
+	return group, nil
+}
+
+func (s *memoryStore) PutGroup(group Group) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.data.Groups[group.Name]
+	s.data.Groups[group.Name] = group
+
+	return s.save(func() {
+		if existed {
+			s.data.Groups[group.Name] = previous
+		} else {
+			delete(s.data.Groups, group.Name)
+		}
+	})
+}
+
+func (s *memoryStore) DeleteGroup(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, found := s.data.Groups[name]
+	if !found {
+		return GroupNotFoundError{name}
+	}
+
+	delete(s.data.Groups, name)
+
+	return s.save(func() {
+		s.data.Groups[name] = previous
+	})
+}
+
+func (s *memoryStore) Endpoints() ([]Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	endpoints := make([]Endpoint, 0, len(s.data.Endpoints))
+	for _, endpoint := range s.data.Endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+
+	return endpoints, nil
+}
+
+func (s *memoryStore) Endpoint(address string) (Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	endpoint, found := s.data.Endpoints[address]
+	if !found {
+		return Endpoint{}, EndpointNotFoundError{address}
+	}
+
+	return endpoint, nil
+}
+
+func (s *memoryStore) AddEndpoint(endpoint Endpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.data.Endpoints[endpoint.Address]
+	s.data.Endpoints[endpoint.Address] = endpoint
+
+	return s.save(func() {
+		if existed {
+			s.data.Endpoints[endpoint.Address] = previous
+		} else {
+			delete(s.data.Endpoints, endpoint.Address)
+		}
+	})
+}
+
+func (s *memoryStore) RemoveEndpoint(address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, found := s.data.Endpoints[address]
+	if !found {
+		return EndpointNotFoundError{address}
+	}
+
+	delete(s.data.Endpoints, address)
+
+	return s.save(func() {
+		s.data.Endpoints[address] = previous
+	})
+}
+
+func (s *memoryStore) Rules() ([]Rule, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rules := make([]Rule, len(s.data.Rules))
+	copy(rules, s.data.Rules)
+
+	return rules, nil
+}
+
+func (s *memoryStore) Rule(id string) (Rule, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, rule := range s.data.Rules {
+		if rule.ID == id {
+			return rule, nil
+		}
+	}
+
+	return Rule{}, RuleNotFoundError{id}
+}
+
+// PutRule replaces the rule with the same ID in place, or appends it.
+func (s *memoryStore) PutRule(rule Rule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.data.Rules
+	rules := make([]Rule, len(previous), len(previous)+1)
+	copy(rules, previous)
+
+	replaced := false
+	for i, existing := range rules {
+		if existing.ID == rule.ID {
+			rules[i] = rule
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	s.data.Rules = rules
+
+	return s.save(func() {
+		s.data.Rules = previous
+	})
+}
+
+func (s *memoryStore) DeleteRule(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.data.Rules
+	rules := make([]Rule, 0, len(previous))
+	for _, rule := range previous {
+		if rule.ID != id {
+			rules = append(rules, rule)
+		}
+	}
+
+	if len(rules) == len(previous) {
+		return RuleNotFoundError{id}
+	}
+
+	s.data.Rules = rules
+
+	return s.save(func() {
+		s.data.Rules = previous
+	})
+}
+
+func (s *memoryStore) SetRules(rules []Rule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.data.Rules
+	s.data.Rules = make([]Rule, len(rules))
+	copy(s.data.Rules, rules)
+
+	return s.save(func() {
+		s.data.Rules = previous
+	})
+}
+
+func (s *memoryStore) ReplaceConfig(groups []Group, rules []Rule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previousGroups, previousRules := s.data.Groups, s.data.Rules
+
+	s.data.Groups = make(map[string]Group, len(groups))
+	for _, group := range groups {
+		s.data.Groups[group.Name] = group
+	}
+
+	s.data.Rules = make([]Rule, len(rules))
+	copy(s.data.Rules, rules)
+
+	return s.save(func() {
+		s.data.Groups, s.data.Rules = previousGroups, previousRules
+	})
+}
+
+func (s *memoryStore) Overrides() ([]Override, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	overrides := make([]Override, 0, len(s.data.Overrides))
+	for _, override := range s.data.Overrides {
+		overrides = append(overrides, override)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Space < overrides[j].Space })
+
+	return overrides, nil
+}
+
+func (s *memoryStore) Override(space string) (Override, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	override, found := s.data.Overrides[space]
+	if !found {
+		return Override{}, OverrideNotFoundError{space}
+	}
+
+	return override, nil
+}
+
+func (s *memoryStore) PutOverride(override Override) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.data.Overrides[override.Space]
+	s.data.Overrides[override.Space] = override
+
+	return s.save(func() {
+		if existed {
+			s.data.Overrides[override.Space] = previous
+		} else {
+			delete(s.data.Overrides, override.Space)
+		}
+	})
+}
+
+func (s *memoryStore) DeleteOverride(space string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, found := s.data.Overrides[space]
+	if !found {
+		return OverrideNotFoundError{space}
+	}
+
+	delete(s.data.Overrides, space)
+
+	return s.save(func() {
+		s.data.Overrides[space] = previous
+	})
+}
+
+func (s *memoryStore) Webhooks() ([]Webhook, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(s.data.Webhooks))
+	for _, webhook := range s.data.Webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+
+	return webhooks, nil
+}
+
+func (s *memoryStore) Webhook(id string) (Webhook, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	webhook, found := s.data.Webhooks[id]
+	if !found {
+		return Webhook{}, WebhookNotFoundError{id}
+	}
+
+	return webhook, nil
+}
+
+func (s *memoryStore) PutWebhook(webhook Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.data.Webhooks[webhook.ID]
+	s.data.Webhooks[webhook.ID] = webhook
+
+	return s.save(func() {
+		if existed {
+			s.data.Webhooks[webhook.ID] = previous
+		} else {
+			delete(s.data.Webhooks, webhook.ID)
+		}
+	})
+}
+
+func (s *memoryStore) DeleteWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, found := s.data.Webhooks[id]
+	if !found {
+		return WebhookNotFoundError{id}
+	}
+
+	delete(s.data.Webhooks, id)
+
+	return s.save(func() {
+		s.data.Webhooks[id] = previous
+	})
+}
+
+func (s *memoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.persist == nil {
+		return nil
+	}
+
+	return s.persist(s.data)
+}
+
+// save must be called with the mutex held.
+func (s *memoryStore) save(rollback func()) error {
+	if s.persist == nil {
+		return nil
+	}
+
+	if err := s.persist(s.data); err != nil {
+		rollback()
+		return err
+	}
+
+	return nil
+}
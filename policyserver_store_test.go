@@ -0,0 +1,187 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStoreGroupsAndEndpoints(t *testing.T) {
+	store := NewMemoryStore()
+
+	for _, group := range []Group{
+		{Name: "red", PoolID: 2, PortRanges: []string{"63332/1666"}},
+		{Name: "blue", PoolID: 0, PortRanges: []string{"60000/1666"}},
+	} {
+		if err := store.PutGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := store.Groups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Name != "blue" || groups[1].Name != "red" {
+		t.Errorf("groups %+v, want blue and red sorted by name", groups)
+	}
+
+	if _, err := store.Group("green"); err != (GroupNotFoundError{"green"}) {
+		t.Errorf("got %v, want GroupNotFoundError", err)
+	}
+
+	endpoint := Endpoint{Space: "space", Address: "10.0.0.1:60000", Group: "blue"}
+	if err := store.AddEndpoint(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Endpoint(endpoint.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != endpoint {
+		t.Errorf("endpoint %+v, want %+v", got, endpoint)
+	}
+
+	if err := store.RemoveEndpoint(endpoint.Address); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveEndpoint(endpoint.Address); err != (EndpointNotFoundError{endpoint.Address}) {
+		t.Errorf("got %v, want EndpointNotFoundError", err)
+	}
+
+	if err := store.DeleteGroup("red"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteGroup("red"); err != (GroupNotFoundError{"red"}) {
+		t.Errorf("got %v, want GroupNotFoundError", err)
+	}
+}
+
+func TestMemoryStoreRules(t *testing.T) {
+	store := NewMemoryStore()
+
+	for _, rule := range []Rule{
+		{ID: "1", Group: "blue"},
+		{ID: "2", Group: "green"},
+	} {
+		if err := store.PutRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.PutRule(Rule{ID: "1", Group: "red"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := store.Rules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].ID != "1" || rules[0].Group != "red" || rules[1].ID != "2" {
+		t.Errorf("rules %+v, want rule 1 replaced in place", rules)
+	}
+
+	if err := store.DeleteRule("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Rule("1"); err != (RuleNotFoundError{"1"}) {
+		t.Errorf("got %v, want RuleNotFoundError", err)
+	}
+}
+
+func TestFileStorePersists(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "store.json")
+
+	store, err := NewFileStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := Group{Name: "red", PoolID: 2, PortRanges: []string{"63332/1666"}}
+	rule := Rule{ID: "prod", Group: "red", SpaceName: "prod"}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddEndpoint(Endpoint{Space: "space", Address: "10.0.0.1:63332", Group: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotGroup, err := reopened.Group("red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotGroup, group) {
+		t.Errorf("group %+v, want %+v", gotGroup, group)
+	}
+
+	if _, err := reopened.Endpoint("10.0.0.1:63332"); err != nil {
+		t.Error(err)
+	}
+
+	gotRule, err := reopened.Rule("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotRule.Matches(SpaceInfo{Name: "prod-1"}) || gotRule.Matches(SpaceInfo{Name: "dev"}) {
+		t.Error("expected the reloaded rule to be compiled")
+	}
+}
+
+func TestFileStoreRollsBackFailedWrites(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "missing", "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutGroup(Group{Name: "red"}); err == nil {
+		t.Fatal("expected writing to a missing directory to fail")
+	}
+
+	if _, err := store.Group("red"); err != (GroupNotFoundError{"red"}) {
+		t.Errorf("got %v, want the group to be rolled back", err)
+	}
+}
+
+func TestReplaceConfig(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutGroup(Group{Name: "blue"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRule(Rule{ID: "1", Group: "blue"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.ReplaceConfig([]Group{{Name: "red"}}, []Rule{{ID: "2", Group: "red"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, _ := store.Groups()
+	if len(groups) != 1 || groups[0].Name != "red" {
+		t.Errorf("groups %+v, want only red", groups)
+	}
+
+	rules, _ := store.Rules()
+	if len(rules) != 1 || rules[0].ID != "2" {
+		t.Errorf("rules %+v, want only rule 2", rules)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// fakeSpaceDirectory stands in for Cloud Controller. With no spaces it is
+// unreachable.
+type fakeSpaceDirectory struct {
+	spaces []SpaceInfo
+}
+
+func (d fakeSpaceDirectory) Spaces() ([]SpaceInfo, error) {
+	if len(d.spaces) == 0 {
+		return nil, errors.New("cloud controller is unreachable")
+	}
+	return d.spaces, nil
+}
+
+func (d fakeSpaceDirectory) Space(guid string) (SpaceInfo, error) {
+	for _, space := range d.spaces {
+		if space.Guid == guid {
+			return space, nil
+		}
+	}
+	return SpaceInfo{}, SpaceNotFoundError{guid}
+}
+
+func (d fakeSpaceDirectory) Ping() error {
+	if len(d.spaces) == 0 {
+		return errors.New("cloud controller is unreachable")
+	}
+	return nil
+}
+
+var testSpaces = []SpaceInfo{
+	{Guid: "dev-guid", Name: "my-dev", OrgName: "org"},
+	{Guid: "prod-guid", Name: "devops-prod", OrgName: "org"},
+}
+
+// newTestBroker sets up a broker with the default config, a file store and
+// the in-memory backend, and a server for its API behind auth as main does.
+// The server is not started yet, so that tests can choose TLS.
+func newTestBroker(t *testing.T, auth AuthConfig) (*broker, *httptest.Server, *MemoryBackend) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestBrokerWithStore(t, auth, store)
+}
+
+// newTestBrokerWithStore is newTestBroker with the given store, for tests
+// that reopen it.
+func newTestBrokerWithStore(t *testing.T, auth AuthConfig, store Store) (*broker, *httptest.Server, *MemoryBackend) {
+	logger := lager.NewLogger("test")
+
+	backend := NewMemoryBackend()
+
+	b := &broker{
+		store:    store,
+		cache:    NewSpaceCache(fakeSpaceDirectory{testSpaces}, time.Minute, logger),
+		backend:  backend,
+		audit:    NewNoopAuditLog(),
+		webhooks: NewWebhookDispatcher(store, time.Second, 1, time.Millisecond, 10, 10, 10, logger),
+		logger:   logger,
+	}
+	t.Cleanup(b.webhooks.Stop)
+
+	config := defaultConfig
+	config.Rules = append([]Rule(nil), defaultConfig.Rules...)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.seedConfig(logger, systemActor, &config); err != nil {
+		t.Fatal(err)
+	}
+	b.config.Set(&config)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/spacegroup", b.sg)
+	b.registerAPI(mux)
+
+	server := httptest.NewUnstartedServer(withRequestLogging(logger, instrument(mux, requireAuth(auth, mux))))
+	t.Cleanup(server.Close)
+
+	return b, server, backend
+}
+
+// apiRequest sends body, if any, as JSON to the started server and decodes
+// the response into out, if given. It returns the status.
+func apiRequest(t *testing.T, server *httptest.Server, method, path string, body, out interface{}) int {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %s", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
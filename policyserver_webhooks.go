@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+var webhookTimeout = flag.Duration(
+	"webhookTimeout",
+	10*time.Second,
+	"timeout of a single webhook delivery attempt",
+)
+
+var webhookMaxAttempts = flag.Int(
+	"webhookMaxAttempts",
+	5,
+	"delivery attempts before a webhook event is dead-lettered",
+)
+
+var webhookRetryInterval = flag.Duration(
+	"webhookRetryInterval",
+	time.Second,
+	"wait before the first webhook retry, doubled after every further failure",
+)
+
+var webhookHistory = flag.Int(
+	"webhookHistory",
+	100,
+	"delivered deliveries kept per webhook for the delivery status API",
+)
+
+var webhookDeadLetters = flag.Int(
+	"webhookDeadLetters",
+	100,
+	"dead letters kept per webhook for redelivery; the oldest are dropped beyond that",
+)
+
+var webhookQueueSize = flag.Int(
+	"webhookQueueSize",
+	1000,
+	"deliveries waiting per webhook; events beyond that are dead-lettered right away",
+)
+
+// The events webhooks can subscribe to. An endpoint moving to another group
+// leaves the old group and joins the new one.
+const (
+	EventEndpointAdded   = "endpoint.added"
+	EventEndpointRemoved = "endpoint.removed"
+)
+
+var eventTypes = []string{EventEndpointAdded, EventEndpointRemoved}
+
+// The headers every delivery carries. The signature is the hex HMAC-SHA256
+// of the body keyed with the webhook's secret, prefixed with "sha256=".
+const (
+	EventHeader     = "X-Policy-Broker-Event"
+	DeliveryHeader  = "X-Policy-Broker-Delivery"
+	SignatureHeader = "X-Policy-Broker-Signature"
+)
+
+// Webhook subscribes URL to Events, or to every event when Events is empty.
+// The secret is only ever returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (w Webhook) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w Webhook) redacted() Webhook {
+	w.Secret = ""
+	return w
+}
+
+func (w Webhook) validate() []string {
+	var problems []string
+
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, "url must be an absolute http or https URL")
+	}
+
+	for _, event := range w.Events {
+		known := false
+		for _, eventType := range eventTypes {
+			known = known || event == eventType
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("unknown event %q, must be one of %s", event, strings.Join(eventTypes, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// WebhookEvent is the JSON body of a delivery.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Space     string    `json:"space"`
+	Endpoint  string    `json:"endpoint"`
+	Group     string    `json:"group"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Delivery is the status of one event sent to one webhook.
+type Delivery struct {
+	ID        string       `json:"id"`
+	Webhook   string       `json:"webhook"`
+	Event     WebhookEvent `json:"event"`
+	Status    string       `json:"status"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"last_error,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type DeliveryNotFoundError struct {
+	ID string
+}
+
+func (err DeliveryNotFoundError) Error() string {
+	return fmt.Sprintf("delivery does not exist: %s", err.ID)
+}
+
+// webhookDispatcher delivers events to every webhook subscribed to them. Each
+// webhook has one worker delivering its events in order, retrying with
+// exponential backoff, from a bounded queue; so a receiver that is down
+// holds up only its own events, and only up to the queue size. Delivery
+// status is only kept in memory: pending deliveries and dead letters do not
+// survive a restart.
+type webhookDispatcher struct {
+	store         Store
+	client        *http.Client
+	maxAttempts   int
+	retryInterval time.Duration
+	history       int
+	deadLetters   int
+	queueSize     int
+	logger        lager.Logger
+
+	mutex       sync.Mutex
+	deliveries  map[string][]*Delivery
+	subscribers map[string]*subscriber
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// subscriber is the queue and worker of one webhook. quit is closed when the
+// webhook is deleted.
+type subscriber struct {
+	queue chan *Delivery
+	quit  chan struct{}
+}
+
+func NewWebhookDispatcher(store Store, timeout time.Duration, maxAttempts int, retryInterval time.Duration, history, deadLetters, queueSize int, logger lager.Logger) *webhookDispatcher {
+	return &webhookDispatcher{
+		store:         store,
+		client:        &http.Client{Timeout: timeout},
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
+		history:       history,
+		deadLetters:   deadLetters,
+		queueSize:     queueSize,
+		logger:        logger.Session("webhooks"),
+		deliveries:    make(map[string][]*Delivery),
+		subscribers:   make(map[string]*subscriber),
+		stop:          make(chan struct{}),
+	}
+}
+
+func (d *webhookDispatcher) Publish(event WebhookEvent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// listed under the mutex: a webhook deleted after being listed is only
+	// forgotten once its worker is started, so that the worker is stopped
+	webhooks, err := d.store.Webhooks()
+	if err != nil {
+		d.logger.Error("failed-to-list-webhooks", err, lager.Data{"event": event.ID})
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.wants(event.Type) {
+			continue
+		}
+
+		now := time.Now().UTC()
+		delivery := &Delivery{
+			ID:        newID(),
+			Webhook:   webhook.ID,
+			Event:     event,
+			Status:    DeliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		d.deliveries[webhook.ID] = append(d.deliveries[webhook.ID], delivery)
+		d.enqueue(delivery)
+		d.deliveries[webhook.ID] = d.trim(d.deliveries[webhook.ID])
+	}
+}
+
+// enqueue hands the delivery to its webhook's worker, starting it if need
+// be, or dead-letters it if the queue is full. It must be called with the
+// mutex held.
+func (d *webhookDispatcher) enqueue(delivery *Delivery) bool {
+	sub, found := d.subscribers[delivery.Webhook]
+	if !found {
+		sub = &subscriber{
+			queue: make(chan *Delivery, d.queueSize),
+			quit:  make(chan struct{}),
+		}
+		d.subscribers[delivery.Webhook] = sub
+
+		d.wg.Add(1)
+		go d.work(sub)
+	}
+
+	select {
+	case sub.queue <- delivery:
+		return true
+	default:
+	}
+
+	delivery.Status = DeliveryDead
+	delivery.LastError = "delivery queue is full"
+	delivery.UpdatedAt = time.Now().UTC()
+
+	webhookDeliveries.Inc("dead")
+	d.logger.Error("queue-full", nil, lager.Data{"webhook": delivery.Webhook, "delivery": delivery.ID, "event": delivery.Event.Type})
+
+	return false
+}
+
+func (d *webhookDispatcher) work(sub *subscriber) {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case delivery := <-sub.queue:
+			d.deliver(delivery, sub.quit)
+		case <-sub.quit:
+			return
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// trim drops the oldest delivered deliveries beyond the history size and the
+// oldest dead letters beyond their limit. Pending deliveries are bounded by
+// the queue size. It must be called with the mutex held.
+func (d *webhookDispatcher) trim(deliveries []*Delivery) []*Delivery {
+	counts := make(map[string]int)
+	for _, delivery := range deliveries {
+		counts[delivery.Status]++
+	}
+
+	limits := map[string]int{DeliveryDelivered: d.history, DeliveryDead: d.deadLetters}
+
+	kept := deliveries[:0]
+	for _, delivery := range deliveries {
+		if limit, limited := limits[delivery.Status]; limited && counts[delivery.Status] > limit {
+			counts[delivery.Status]--
+			continue
+		}
+		kept = append(kept, delivery)
+	}
+
+	return kept
+}
+
+// deliver retries until the receiver accepts the event, the attempts run out
+// or the webhook is deleted. The webhook is looked up on every attempt so
+// that a changed secret or URL takes effect.
+func (d *webhookDispatcher) deliver(delivery *Delivery, quit chan struct{}) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		panic(fmt.Sprintf("encoding webhook event: %s", err)) // should never happen..
+	}
+
+	logger := d.logger.Session("deliver", lager.Data{
+		"webhook":  delivery.Webhook,
+		"delivery": delivery.ID,
+		"event":    delivery.Event.Type,
+	})
+
+	wait := d.retryInterval
+	for attempt := 1; ; attempt++ {
+		webhook, err := d.store.Webhook(delivery.Webhook)
+		if err != nil {
+			logger.Info("webhook-gone", lager.Data{"error": err.Error()})
+			return
+		}
+
+		err = d.post(webhook, delivery, body)
+
+		d.mutex.Lock()
+		delivery.Attempts++
+		delivery.UpdatedAt = time.Now().UTC()
+		switch {
+		case err == nil:
+			delivery.Status = DeliveryDelivered
+			delivery.LastError = ""
+		case attempt >= d.maxAttempts:
+			delivery.Status = DeliveryDead
+			delivery.LastError = err.Error()
+		default:
+			delivery.LastError = err.Error()
+		}
+		status := delivery.Status
+		if status != DeliveryPending {
+			d.deliveries[delivery.Webhook] = d.trim(d.deliveries[delivery.Webhook])
+		}
+		d.mutex.Unlock()
+
+		switch status {
+		case DeliveryDelivered:
+			webhookDeliveries.Inc("delivered")
+			logger.Debug("delivered", lager.Data{"attempts": attempt})
+			return
+		case DeliveryDead:
+			webhookDeliveries.Inc("dead")
+			logger.Error("dead-lettered", err, lager.Data{"attempts": attempt})
+			return
+		}
+
+		webhookDeliveries.Inc("failed")
+		logger.Info("retrying", lager.Data{"attempt": attempt, "error": err.Error(), "wait": wait.String()})
+
+		select {
+		case <-time.After(wait):
+		case <-quit:
+			return
+		case <-d.stop:
+			return
+		}
+
+		wait *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(webhook Webhook, delivery *Delivery, body []byte) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the signature header value receivers check a body against.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries returns copies of the webhook's deliveries, oldest first,
+// optionally only those with the given status.
+func (d *webhookDispatcher) Deliveries(webhook string, status string) []Delivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range d.deliveries[webhook] {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+
+	return deliveries
+}
+
+// Redeliver gives a dead letter a fresh set of attempts.
+func (d *webhookDispatcher) Redeliver(webhook string, id string) (Delivery, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, delivery := range d.deliveries[webhook] {
+		if delivery.ID != id {
+			continue
+		}
+
+		if delivery.Status != DeliveryDead {
+			return Delivery{}, ConflictError{fmt.Sprintf("delivery %s is %s, only dead deliveries can be redelivered", id, delivery.Status)}
+		}
+
+		delivery.Status = DeliveryPending
+		delivery.Attempts = 0
+		delivery.UpdatedAt = time.Now().UTC()
+
+		if !d.enqueue(delivery) {
+			return Delivery{}, ConflictError{fmt.Sprintf("the delivery queue of webhook %s is full", webhook)}
+		}
+
+		return *delivery, nil
+	}
+
+	return Delivery{}, DeliveryNotFoundError{id}
+}
+
+// Forget stops a deleted webhook's worker and drops the status of its
+// deliveries.
+func (d *webhookDispatcher) Forget(webhook string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if sub, found := d.subscribers[webhook]; found {
+		close(sub.quit)
+		delete(d.subscribers, webhook)
+	}
+
+	delete(d.deliveries, webhook)
+}
+
+// Stop abandons queued deliveries and pending retries and waits for attempts
+// in flight.
+func (d *webhookDispatcher) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// notify publishes an endpoint joining or leaving a group.
+func (b *broker) notify(actor Actor, eventType string, endpoint Endpoint) {
+	b.webhooks.Publish(WebhookEvent{
+		ID:        newID(),
+		Type:      eventType,
+		Time:      time.Now().UTC(),
+		RequestID: actor.RequestID,
+		Space:     endpoint.Space,
+		Endpoint:  endpoint.Address,
+		Group:     endpoint.Group,
+	})
+}
+
+func (b *broker) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		webhooks, err := b.store.Webhooks()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		redacted := make([]Webhook, 0, len(webhooks))
+		for _, webhook := range webhooks {
+			redacted = append(redacted, webhook.redacted())
+		}
+
+		writeJSON(w, http.StatusOK, redacted)
+
+	case "POST":
+		var webhook Webhook
+		if err := decodeJSON(r, &webhook); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		actor := requestActor(r)
+		webhook.ID = newID()
+		webhook.CreatedBy = actor.Name
+		webhook.CreatedAt = time.Now().UTC()
+		if webhook.Secret == "" {
+			webhook.Secret = newID() + newID()
+		}
+
+		if problems := webhook.validate(); len(problems) > 0 {
+			writeError(w, InvalidRequestError{strings.Join(problems, "; ")})
+			return
+		}
+
+		if err := b.store.PutWebhook(webhook); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		b.record(requestLogger(r), actor, AuditEvent{Action: "create-webhook", After: webhook.redacted()})
+
+		writeJSON(w, http.StatusCreated, webhook)
+
+	default:
+		methodNotAllowed(w, "GET", "POST")
+	}
+}
+
+// webhookHandler serves /v1/webhooks/{id}, its deliveries and redelivery of
+// a dead letter at /v1/webhooks/{id}/deliveries/{delivery}/redeliver.
+func (b *broker) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(pathParam(r, "/v1/webhooks/"), "/")
+	id := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		b.webhook(w, r, id)
+
+	case len(parts) == 2 && parts[1] == "deliveries":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+
+		if _, err := b.store.Webhook(id); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, b.webhooks.Deliveries(id, r.URL.Query().Get("status")))
+
+	case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "redeliver":
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+
+		if _, err := b.store.Webhook(id); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		delivery, err := b.webhooks.Redeliver(id, parts[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, delivery)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (b *broker) webhook(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case "GET":
+		webhook, err := b.store.Webhook(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, webhook.redacted())
+
+	case "DELETE":
+		webhook, err := b.store.Webhook(id)
+		if err == nil {
+			err = b.store.DeleteWebhook(id)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		b.webhooks.Forget(id)
+		b.record(requestLogger(r), requestActor(r), AuditEvent{Action: "delete-webhook", Before: webhook.redacted()})
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET", "DELETE")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// receiver is a webhook endpoint that answers with the queued statuses, then
+// with 200, and records what it was sent.
+type receiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) received() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.requests)
+}
+
+func newTestDispatcher(t *testing.T, url string, queueSize int) (*webhookDispatcher, Webhook) {
+	store := NewMemoryStore()
+	webhook := Webhook{ID: "hook", URL: url, Secret: "s3cret"}
+	if err := store.PutWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher := NewWebhookDispatcher(store, time.Second, 3, time.Millisecond, 2, 2, queueSize, lager.NewLogger("test"))
+	t.Cleanup(dispatcher.Stop)
+
+	return dispatcher, webhook
+}
+
+func waitForStatus(t *testing.T, dispatcher *webhookDispatcher, webhook, status string, count int) []Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := dispatcher.Deliveries(webhook, status)
+		if len(deliveries) >= count {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d %s deliveries, got %v", count, status, dispatcher.Deliveries(webhook, ""))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForQueue(t *testing.T, dispatcher *webhookDispatcher, webhook string, length int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dispatcher.mutex.Lock()
+		queued := len(dispatcher.subscribers[webhook].queue)
+		dispatcher.mutex.Unlock()
+
+		if queued == length {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued deliveries, got %d", length, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	recv := &receiver{}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	dispatcher, webhook := newTestDispatcher(t, server.URL, 10)
+	dispatcher.Publish(WebhookEvent{ID: "e1", Type: EventEndpointAdded, Space: "space", Endpoint: "10.0.0.1:8080", Group: "red"})
+
+	delivery := waitForStatus(t, dispatcher, webhook.ID, DeliveryDelivered, 1)[0]
+
+	recv.mutex.Lock()
+	req, body := recv.requests[0], recv.bodies[0]
+	recv.mutex.Unlock()
+
+	if got, want := req.Header.Get(SignatureHeader), Sign(webhook.Secret, body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := req.Header.Get(EventHeader); got != EventEndpointAdded {
+		t.Errorf("event header %q, want %q", got, EventEndpointAdded)
+	}
+	if got := req.Header.Get(DeliveryHeader); got != delivery.ID {
+		t.Errorf("delivery header %q, want %q", got, delivery.ID)
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != "e1" || event.Endpoint != "10.0.0.1:8080" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestWebhookDeliveryIsRetried(t *testing.T) {
+	recv := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	dispatcher, webhook := newTestDispatcher(t, server.URL, 10)
+	dispatcher.Publish(WebhookEvent{ID: "e1", Type: EventEndpointAdded})
+
+	delivery := waitForStatus(t, dispatcher, webhook.ID, DeliveryDelivered, 1)[0]
+	if delivery.Attempts != 3 {
+		t.Errorf("attempts %d, want 3", delivery.Attempts)
+	}
+	if delivery.LastError != "" {
+		t.Errorf("last error %q, want none", delivery.LastError)
+	}
+}
+
+func TestWebhookDeliveryIsDeadLettered(t *testing.T) {
+	recv := &receiver{statuses: []int{500, 500, 500}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	dispatcher, webhook := newTestDispatcher(t, server.URL, 10)
+	dispatcher.Publish(WebhookEvent{ID: "e1", Type: EventEndpointAdded})
+
+	dead := waitForStatus(t, dispatcher, webhook.ID, DeliveryDead, 1)[0]
+	if dead.Attempts != 3 || dead.LastError != "receiver answered 500" {
+		t.Errorf("unexpected dead letter %+v", dead)
+	}
+
+	if _, err := dispatcher.Redeliver(webhook.ID, dead.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, dispatcher, webhook.ID, DeliveryDelivered, 1)
+	if got := recv.received(); got != 4 {
+		t.Errorf("received %d requests, want 4", got)
+	}
+
+	if _, err := dispatcher.Redeliver(webhook.ID, dead.ID); err == nil {
+		t.Error("expected redelivering a delivered delivery to fail")
+	}
+}
+
+func TestWebhookHistoryIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dispatcher, webhook := newTestDispatcher(t, server.URL, 1)
+
+	// The first event is in flight, the second queued; the rest find the
+	// queue full and are dead-lettered, of which only the newest two are kept.
+	for i := 0; i < 6; i++ {
+		dispatcher.Publish(WebhookEvent{ID: newID(), Type: EventEndpointAdded})
+		if i == 0 {
+			waitForQueue(t, dispatcher, webhook.ID, 0)
+		}
+	}
+
+	if got := len(dispatcher.Deliveries(webhook.ID, DeliveryPending)); got != 2 {
+		t.Errorf("%d pending deliveries, want 2", got)
+	}
+
+	dead := dispatcher.Deliveries(webhook.ID, DeliveryDead)
+	if len(dead) != 2 {
+		t.Fatalf("%d dead letters, want 2", len(dead))
+	}
+	if dead[0].LastError != "delivery queue is full" {
+		t.Errorf("last error %q", dead[0].LastError)
+	}
+}
+
+func TestDeletedWebhookHasNoWorker(t *testing.T) {
+	dispatcher, _ := newTestDispatcher(t, "http://127.0.0.1:1", 10)
+
+	// deleted the way the API deletes webhooks, while events are published
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("hook-%d", i)
+		if err := dispatcher.store.PutWebhook(Webhook{ID: id, URL: "http://127.0.0.1:1"}); err != nil {
+			t.Fatal(err)
+		}
+
+		published := make(chan struct{})
+		go func() {
+			defer close(published)
+			dispatcher.Publish(WebhookEvent{ID: newID(), Type: EventEndpointAdded})
+		}()
+
+		if err := dispatcher.store.DeleteWebhook(id); err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Forget(id)
+		<-published
+
+		dispatcher.mutex.Lock()
+		_, found := dispatcher.subscribers[id]
+		dispatcher.mutex.Unlock()
+
+		if found {
+			t.Fatalf("a worker was left running for the deleted webhook %s", id)
+		}
+	}
+}
@@ -1,18 +1,149 @@
 package port_pool
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
+
+	"code.cloudfoundry.org/lager"
 )
 
-type PortPool struct {
-	start uint32
-	size  uint32
+// Range is a block of Size ports starting at Start.
+type Range struct {
+	Start uint32 `json:"start"`
+	Size  uint32 `json:"size"`
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d/%d", r.Start, r.Size)
+}
+
+func (r Range) contains(port uint32) bool {
+	return port >= r.Start && port < r.Start+r.Size
+}
+
+// Group is a named set of port ranges. Its ports are handed out in the order
+// of its ranges.
+type Group struct {
+	Name   string  `json:"name"`
+	Ranges []Range `json:"ranges"`
+}
+
+func (g Group) size() uint32 {
+	var size uint32
+	for _, r := range g.Ranges {
+		size += r.Size
+	}
+	return size
+}
+
+// index returns the position of port among the group's ports.
+func (g Group) index(port uint32) (uint32, bool) {
+	var offset uint32
+	for _, r := range g.Ranges {
+		if r.contains(port) {
+			return offset + port - r.Start, true
+		}
+		offset += r.Size
+	}
+	return 0, false
+}
+
+// Uniform splits size ports from start into one equal group per name, in
+// order. The last group also takes the ports that do not divide evenly.
+func Uniform(start, size uint32, names []string) ([]Group, error) {
+	groups := uint32(len(names))
+	if groups == 0 || size < groups {
+		return nil, fmt.Errorf("port_pool: Uniform: size %d cannot be split into %d groups", size, groups)
+	}
+
+	step := size / groups
+	layout := make([]Group, groups)
+	for i, name := range names {
+		layout[i] = Group{
+			Name:   name,
+			Ranges: []Range{{Start: start + step*uint32(i), Size: step}},
+		}
+	}
+	layout[groups-1].Ranges[0].Size += size % groups
+
+	return layout, nil
+}
+
+// LoadLayout reads a JSON list of groups.
+func LoadLayout(filePath string) ([]Group, error) {
+	layoutFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening layout file: %s", err)
+	}
+	defer layoutFile.Close()
 
-	pools      [][]uint32
-	poolMutex sync.Mutex
+	var layout []Group
+	if err := json.NewDecoder(layoutFile).Decode(&layout); err != nil {
+		return nil, fmt.Errorf("parsing layout file: %s", err)
+	}
 
-	states States
+	return layout, nil
+}
+
+// Validate checks that every group is named uniquely and that no two ranges
+// overlap, in the same group or across groups.
+func Validate(layout []Group) error {
+	if len(layout) == 0 {
+		return fmt.Errorf("port_pool: no groups")
+	}
+
+	type namedRange struct {
+		Range
+		group string
+	}
+
+	var ranges []namedRange
+	names := make(map[string]bool)
+	for _, group := range layout {
+		if group.Name == "" {
+			return fmt.Errorf("port_pool: group without a name")
+		}
+		if names[group.Name] {
+			return fmt.Errorf("port_pool: group %s defined twice", group.Name)
+		}
+		names[group.Name] = true
+
+		if len(group.Ranges) == 0 {
+			return fmt.Errorf("port_pool: group %s has no ranges", group.Name)
+		}
+
+		for _, r := range group.Ranges {
+			if r.Start == 0 || r.Size == 0 || r.Size > 65536 || r.Start+r.Size > 65536 {
+				return fmt.Errorf("port_pool: group %s: invalid port range %s", group.Name, r)
+			}
+			ranges = append(ranges, namedRange{r, group.Name})
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for i := 1; i < len(ranges); i++ {
+		previous, r := ranges[i-1], ranges[i]
+		if previous.Start+previous.Size > r.Start {
+			return fmt.Errorf("port_pool: range %s of group %s overlaps range %s of group %s", r.Range, r.group, previous.Range, previous.group)
+		}
+	}
+
+	return nil
+}
+
+type PortPool struct {
+	groups   []Group
+	index    map[string]int
+	filePath string
+	logger   lager.Logger
+
+	pools       [][]uint32
+	allocations map[uint32]string
+	reserved    map[uint32]string
+	poolMutex   sync.Mutex
 }
 
 type PoolExhaustedError struct{}
@@ -29,142 +160,358 @@ func (e PortTakenError) Error() string {
 	return fmt.Sprintf("port already acquired: %d", e.Port)
 }
 
-func New(start, size uint32, groups uint32, states States) (*PortPool, error) {
-	if start+size > 65535 {
-		return nil, fmt.Errorf("port_pool: New: invalid port range: startL %d, size: %d", start, size)
+type UnknownGroupError struct {
+	Name string
+}
+
+func (e UnknownGroupError) Error() string {
+	return fmt.Sprintf("port pool group does not exist: %s", e.Name)
+}
+
+type ConflictReason string
+
+const (
+	// the port is in the snapshots of two containers
+	ConflictClaimedTwice ConflictReason = "claimed-twice"
+	// the port is in no group, so nothing stops it being mapped again
+	ConflictOutsidePool ConflictReason = "outside-pool"
+	// the state had the port allocated to another container
+	ConflictReassigned ConflictReason = "reassigned"
+	// the port is neither free nor allocated, so it cannot be taken
+	ConflictUnavailable ConflictReason = "unavailable"
+)
+
+// Conflict is a restored port Reconcile could not account for cleanly.
+// Handle is the container it was restored for, Owner the other container
+// claiming it.
+type Conflict struct {
+	Port   uint32
+	Handle string
+	Owner  string
+	Reason ConflictReason
+}
+
+func (c Conflict) Error() string {
+	switch c.Reason {
+	case ConflictClaimedTwice:
+		return fmt.Sprintf("port %d of container %s is also mapped by container %s", c.Port, c.Handle, c.Owner)
+	case ConflictOutsidePool:
+		return fmt.Sprintf("port %d of container %s is outside every port pool group", c.Port, c.Handle)
+	case ConflictReassigned:
+		return fmt.Sprintf("port %d of container %s was allocated to container %s", c.Port, c.Handle, c.Owner)
+	case ConflictUnavailable:
+		return fmt.Sprintf("port %d of container %s is neither free nor allocated in its group", c.Port, c.Handle)
+	default:
+		panic("unknown conflict reason: " + string(c.Reason)) // should never happen..
 	}
+}
 
-	//call new() for each one
-	pools := make ([][]uint32, groups)
-	step := size/groups
-	for i, _ := range pools {
-		pools[i], _ = fill(start+step* uint32(i), step, states[i])
-		i++
+// New creates a pool per group of layout, acquired from by name, resuming
+// from state. The state is saved to filePath after every change, unless it
+// is empty. Allocations of ports outside every group are dropped.
+func New(layout []Group, state State, filePath string, logger lager.Logger) (*PortPool, error) {
+	if err := Validate(layout); err != nil {
+		return nil, err
 	}
 
-	return &PortPool{
-		start: start,
-		size:  size,
+	p := &PortPool{
+		groups:      layout,
+		index:       make(map[string]int, len(layout)),
+		filePath:    filePath,
+		logger:      logger.Session("port-pool"),
+		pools:       make([][]uint32, len(layout)),
+		allocations: make(map[uint32]string),
+		reserved:    make(map[uint32]string),
+	}
+
+	for i, group := range layout {
+		p.pools[i] = fill(group, state.Groups[group.Name])
+		p.index[group.Name] = i
+	}
 
-		pools: pools,
-	}, nil
+	for name, group := range state.Groups {
+		for _, allocation := range group.Allocations {
+			if err := p.take(allocation.Port, allocation.Handle); err != nil {
+				p.logger.Info("dropping-allocation", lager.Data{"group": name, "port": allocation.Port, "handle": allocation.Handle, "error": err.Error()})
+			}
+		}
+	}
+
+	return p, nil
 }
 
-func fill (start, size uint32, state State) ([]uint32, error) {
+// fill lists the group's ports starting at state.Offset, wrapping around.
+func fill(group Group, state GroupState) []uint32 {
+	size := group.size()
 	if state.Offset >= size {
 		state.Offset = 0
 	}
 
-	pool := make([]uint32, size)
-
-	i := 0
-	for port := start + state.Offset; port < start+size; port++ {
-		pool[i] = port
-		i += 1
-	}
-	for port := start; port < start+state.Offset; port++ {
-		pool[i] = port
-		i += 1
+	pool := make([]uint32, 0, size)
+	for _, r := range group.Ranges {
+		for port := r.Start; port < r.Start+r.Size; port++ {
+			pool = append(pool, port)
+		}
 	}
-	return pool, nil
+
+	return append(pool[state.Offset:], pool[:state.Offset]...)
+}
+
+// Groups returns the layout the pool was created with.
+func (p *PortPool) Groups() []Group {
+	return p.groups
 }
 
-func (p *PortPool) Acquire(index int) (uint32, error) {
+// Acquire takes the next port of the group for the container with the given
+// handle.
+func (p *PortPool) Acquire(group, handle string) (uint32, error) {
 	p.poolMutex.Lock()
 	defer p.poolMutex.Unlock()
-        i := uint32(index)
-	if index > len(p.pools) {
-		i = 0
+
+	index, found := p.index[group]
+	if !found {
+		return 0, UnknownGroupError{group}
 	}
-	var port uint32
-	port, p.pools[i]= acquire(p.pools[i])
-	if port == 0 {
+
+	if len(p.pools[index]) == 0 {
 		return 0, PoolExhaustedError{}
 	}
+
+	port := p.pools[index][0]
+	p.pools[index] = p.pools[index][1:]
+	p.allocations[port] = handle
+	p.save()
+
 	return port, nil
 }
 
-func acquire(pool []uint32) (uint32, []uint32) {
-	if len(pool) == 0 {
-		return 0, pool
+// Remove takes a specific port out of the pool, failing if it is not free.
+// A port Reconcile reserved is taken already, so its first Remove succeeds
+// and it stays allocated to the container it was reserved for.
+func (p *PortPool) Remove(port uint32) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	return p.remove(port, p.reserved[port])
+}
+
+// RemoveFor is Remove for the container with the given handle. The first
+// RemoveFor of a port Reconcile reserved succeeds only for the same
+// container.
+func (p *PortPool) RemoveFor(port uint32, handle string) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	return p.remove(port, handle)
+}
+
+// remove must be called with the mutex held.
+func (p *PortPool) remove(port uint32, handle string) error {
+	if owner, found := p.reserved[port]; found {
+		if owner != handle {
+			return PortTakenError{port}
+		}
+
+		delete(p.reserved, port)
+		return nil
 	}
 
-	port := pool[0]
+	if err := p.take(port, handle); err != nil {
+		return err
+	}
 
-	pool = pool[1:]
+	p.save()
 
-	return port, pool
+	return nil
 }
 
+// take must be called with the mutex held.
+func (p *PortPool) take(port uint32, handle string) error {
+	i, found := p.group(port)
+	if !found {
+		return PortTakenError{port}
+	}
 
+	for j, existingPort := range p.pools[i] {
+		if existingPort == port {
+			p.pools[i] = append(p.pools[i][:j], p.pools[i][j+1:]...)
+			p.allocations[port] = handle
+			return nil
+		}
+	}
 
-func (p *PortPool) Remove(port uint32) error {
-	idx := 0
-	found := false
+	return PortTakenError{port}
+}
 
+// Release returns a port to its group. Ports outside every group and ports
+// already free are ignored.
+func (p *PortPool) Release(port uint32) {
 	p.poolMutex.Lock()
 	defer p.poolMutex.Unlock()
-//add one more loop, all the code can be contained inside
-	for j, pool := range p.pools {
-		for i, existingPort := range pool {
-			if existingPort == port {
-				idx = i
-				found = true
-				break
-			}
-		}
-		p.pools[j] = append(p.pools[j][:idx], p.pools[j][idx+1:]...)
-
 
+	if p.release(port) {
+		p.save()
 	}
+}
 
+// release must be called with the mutex held. It returns whether the pool
+// changed.
+func (p *PortPool) release(port uint32) bool {
+	delete(p.reserved, port)
+
+	i, found := p.group(port)
 	if !found {
-		return PortTakenError{port}
+		return false
 	}
 
-	return nil
+	for _, existingPort := range p.pools[i] {
+		if existingPort == port {
+			return false
+		}
+	}
+
+	p.pools[i] = append(p.pools[i], port)
+	delete(p.allocations, port)
+
+	return true
 }
 
-func (p *PortPool) Release(port uint32) {
-	if port < p.start || port >= p.start+p.size {
-		return
+// Reconcile makes the restored ports, and only those, the pool's
+// allocations, before the containers holding them are restored. Allocations
+// no restored container holds are released; restored ports are reserved so
+// that restoring their container can Remove them, until FinishRestore.
+func (p *PortPool) Reconcile(restored []Allocation) []Conflict {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	var conflicts []Conflict
+
+	claimed := make(map[uint32]string)
+	for _, allocation := range restored {
+		if owner, found := claimed[allocation.Port]; found {
+			if owner != allocation.Handle {
+				conflicts = append(conflicts, Conflict{Port: allocation.Port, Handle: allocation.Handle, Owner: owner, Reason: ConflictClaimedTwice})
+			}
+			continue
+		}
+
+		claimed[allocation.Port] = allocation.Handle
 	}
 
+	released := 0
+	for port, owner := range p.allocations {
+		handle, found := claimed[port]
+		if !found {
+			p.release(port)
+			released++
+			continue
+		}
+
+		if owner != "" && owner != handle {
+			conflicts = append(conflicts, Conflict{Port: port, Handle: handle, Owner: owner, Reason: ConflictReassigned})
+		}
+	}
+
+	for port, handle := range claimed {
+		if _, found := p.group(port); !found {
+			p.reserved[port] = handle
+			conflicts = append(conflicts, Conflict{Port: port, Handle: handle, Reason: ConflictOutsidePool})
+			continue
+		}
+
+		if _, found := p.allocations[port]; found {
+			p.allocations[port] = handle
+		} else if err := p.take(port, handle); err != nil {
+			conflicts = append(conflicts, Conflict{Port: port, Handle: handle, Reason: ConflictUnavailable})
+			continue
+		}
+
+		p.reserved[port] = handle
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Port < conflicts[j].Port })
+
+	p.logger.Info("reconciled", lager.Data{"restored": len(claimed), "released": released, "conflicts": len(conflicts)})
+
+	p.save()
+
+	return conflicts
+}
+
+// FinishRestore drops the reservations Reconcile made for containers that
+// were not restored after all, releasing their ports so that they can be
+// acquired again. It is called once every container has been restored.
+func (p *PortPool) FinishRestore() {
 	p.poolMutex.Lock()
 	defer p.poolMutex.Unlock()
-	//add one more loop, all the code inlcude the append stays in
-	for _, pool := range p.pools {
-		for _, existingPort := range pool {
-			if existingPort == port {
-				return
-			}
+
+	changed := false
+	for port, handle := range p.reserved {
+		if p.release(port) {
+			changed = true
 		}
+
+		p.logger.Info("released-unrestored-port", lager.Data{"port": port, "handle": handle})
 	}
-	// find the right pool to add
-	for i:=len(p.pools) -1 ; i>=0; i- -//change {
-		if port >= p.start + uint32(i) * p.size/uint32(len(p.pools)){
-			p.pools[i] = append(p.pools[i], port)
-			return
+
+	if changed {
+		p.save()
+	}
+}
+
+// Contains reports whether port belongs to one of the groups.
+func (p *PortPool) Contains(port uint32) bool {
+	_, found := p.group(port)
+	return found
+}
+
+// group returns the index of the group port belongs to.
+func (p *PortPool) group(port uint32) (int, bool) {
+	for i, group := range p.groups {
+		if _, found := group.index(port); found {
+			return i, true
 		}
 	}
 
+	return 0, false
+}
 
+func (p *PortPool) RefreshState() State {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	return p.state()
 }
 
-func (p *PortPool) RefreshState() States {
-	//add a loop for all the pools
-	var states States
-	for i, pool := range p.pools {
-		var state State
-		if len(pool) == 0 {
-			state.Offset = 0
-		} else {
-			state.Offset = pool[0] - p.start - uint32(i) * p.size/uint32(len(p.pools))
-			if (state.Offset > p.size) {
-				state.Offset = 0
-			}
+// state must be called with the mutex held.
+func (p *PortPool) state() State {
+	state := State{Version: StateVersion, Layout: p.groups, Groups: make(map[string]GroupState, len(p.groups))}
+	for i, group := range p.groups {
+		var groupState GroupState
+		if len(p.pools[i]) > 0 {
+			groupState.Offset, _ = group.index(p.pools[i][0])
 		}
-		states = append(states,state)
+		state.Groups[group.Name] = groupState
+	}
+
+	for port, handle := range p.allocations {
+		i, _ := p.group(port)
+		groupState := state.Groups[p.groups[i].Name]
+		groupState.Allocations = append(groupState.Allocations, Allocation{Port: port, Handle: handle})
+		state.Groups[p.groups[i].Name] = groupState
+	}
+
+	return state
+}
+
+// save must be called with the mutex held. A failure is only logged: the
+// pool itself has changed either way.
+func (p *PortPool) save() {
+	if p.filePath == "" {
+		return
+	}
+
+	if err := SaveState(p.filePath, p.state()); err != nil {
+		p.logger.Error("failed-to-save-state", err)
 	}
-	return states
 }
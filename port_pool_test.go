@@ -0,0 +1,221 @@
+package port_pool
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func TestUniform(t *testing.T) {
+	layout, err := Uniform(60000, 5000, []string{"blue", "green", "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last group takes the remainder
+	want := []Group{
+		{Name: "blue", Ranges: []Range{{Start: 60000, Size: 1666}}},
+		{Name: "green", Ranges: []Range{{Start: 61666, Size: 1666}}},
+		{Name: "red", Ranges: []Range{{Start: 63332, Size: 1668}}},
+	}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout %v, want %v", layout, want)
+	}
+
+	for _, tc := range []struct {
+		size  uint32
+		names []string
+	}{
+		{2, []string{"blue", "green", "red"}},
+		{5000, nil},
+	} {
+		if _, err := Uniform(60000, tc.size, tc.names); err == nil {
+			t.Errorf("expected %d ports in %d groups to be rejected", tc.size, len(tc.names))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		layout []Group
+		valid  bool
+	}{
+		{"disjoint", []Group{{"a", []Range{{100, 10}, {300, 10}}}, {"b", []Range{{110, 10}}}}, true},
+		{"no groups", nil, false},
+		{"unnamed", []Group{{"", []Range{{100, 10}}}}, false},
+		{"duplicate", []Group{{"a", []Range{{100, 10}}}, {"a", []Range{{200, 10}}}}, false},
+		{"no ranges", []Group{{"a", nil}}, false},
+		{"port zero", []Group{{"a", []Range{{0, 10}}}}, false},
+		{"past 65535", []Group{{"a", []Range{{65530, 10}}}}, false},
+		{"overlap across groups", []Group{{"a", []Range{{100, 10}}}, {"b", []Range{{109, 10}}}}, false},
+		{"overlap in a group", []Group{{"a", []Range{{100, 10}, {105, 10}}}}, false},
+	} {
+		if err := Validate(tc.layout); tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestAcquireAndRelease(t *testing.T) {
+	layout := []Group{
+		{Name: "a", Ranges: []Range{{Start: 100, Size: 2}, {Start: 300, Size: 1}}},
+		{Name: "b", Ranges: []Range{{Start: 200, Size: 1}}},
+	}
+
+	pool, err := New(layout, State{}, "", lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ports []uint32
+	for i := 0; i < 3; i++ {
+		port, err := pool.Acquire("a", "handle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, port)
+	}
+	if !reflect.DeepEqual(ports, []uint32{100, 101, 300}) {
+		t.Errorf("acquired %v, want the ranges in order", ports)
+	}
+
+	if _, err := pool.Acquire("a", "handle"); err != (PoolExhaustedError{}) {
+		t.Errorf("got %v, want PoolExhaustedError", err)
+	}
+	if _, err := pool.Acquire("c", "handle"); err != (UnknownGroupError{"c"}) {
+		t.Errorf("got %v, want UnknownGroupError", err)
+	}
+
+	pool.Release(101)
+	pool.Release(101)
+	pool.Release(999)
+
+	port, err := pool.Acquire("a", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 101 {
+		t.Errorf("acquired %d, want the released port 101", port)
+	}
+
+	if port, err := pool.Acquire("b", "handle"); err != nil || port != 200 {
+		t.Errorf("acquired %d, %v from b, want 200", port, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	layout := []Group{
+		{Name: "a", Ranges: []Range{{Start: 100, Size: 5}}},
+		{Name: "b", Ranges: []Range{{Start: 200, Size: 5}}},
+	}
+	state := State{Groups: map[string]GroupState{
+		"a": {Allocations: []Allocation{{Port: 100, Handle: "x"}, {Port: 101, Handle: "y"}, {Port: 102}}},
+		"b": {Allocations: []Allocation{{Port: 200, Handle: "gone"}}},
+	}}
+
+	pool, err := New(layout, state, "", lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts := pool.Reconcile([]Allocation{
+		{Port: 100, Handle: "x"},
+		{Port: 101, Handle: "w"},
+		{Port: 102, Handle: "v"},
+		{Port: 103, Handle: "x"},
+		{Port: 103, Handle: "q"},
+		{Port: 999, Handle: "x"},
+	})
+
+	wantConflicts := []Conflict{
+		{Port: 101, Handle: "w", Owner: "y", Reason: ConflictReassigned},
+		{Port: 103, Handle: "q", Owner: "x", Reason: ConflictClaimedTwice},
+		{Port: 999, Handle: "x", Reason: ConflictOutsidePool},
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("conflicts %v, want %v", conflicts, wantConflicts)
+	}
+
+	allocations := pool.RefreshState().Groups
+	wantA := []Allocation{{Port: 100, Handle: "x"}, {Port: 101, Handle: "w"}, {Port: 102, Handle: "v"}, {Port: 103, Handle: "x"}}
+	if got := sortedAllocations(allocations["a"].Allocations); !reflect.DeepEqual(got, wantA) {
+		t.Errorf("allocations of a %v, want %v", got, wantA)
+	}
+	if got := allocations["b"].Allocations; len(got) != 0 {
+		t.Errorf("allocations of b %v, want the unclaimed port released", got)
+	}
+
+	if err := pool.RemoveFor(100, "other"); err != (PortTakenError{100}) {
+		t.Errorf("got %v, want a port reserved for x to be refused to another container", err)
+	}
+	if err := pool.RemoveFor(100, "x"); err != nil {
+		t.Errorf("got %v, want restoring x to take its reserved port", err)
+	}
+	if err := pool.RemoveFor(100, "x"); err != (PortTakenError{100}) {
+		t.Errorf("got %v, want the reservation to be used up", err)
+	}
+	if err := pool.RemoveFor(999, "x"); err != nil {
+		t.Errorf("got %v, want the port outside the pool to be reserved for x", err)
+	}
+	if err := pool.Remove(101); err != nil {
+		t.Errorf("got %v, want restoring w without its handle to take its reserved port", err)
+	}
+	if got := sortedAllocations(pool.RefreshState().Groups["a"].Allocations); !reflect.DeepEqual(got, wantA) {
+		t.Errorf("allocations of a %v, want %v", got, wantA)
+	}
+
+	port, err := pool.Acquire("a", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 104 {
+		t.Errorf("acquired %d, want the only unclaimed port 104", port)
+	}
+
+	pool.Release(103)
+	if err := pool.RemoveFor(103, "q"); err != nil {
+		t.Errorf("got %v, want a released port to be free again", err)
+	}
+}
+
+func TestFinishRestoreReleasesUnrestoredPorts(t *testing.T) {
+	layout := []Group{{Name: "a", Ranges: []Range{{Start: 100, Size: 3}}}}
+
+	pool, err := New(layout, State{}, "", lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conflicts := pool.Reconcile([]Allocation{{Port: 100, Handle: "x"}, {Port: 101, Handle: "y"}}); len(conflicts) != 0 {
+		t.Fatalf("conflicts %v", conflicts)
+	}
+
+	// y is never restored
+	if err := pool.RemoveFor(100, "x"); err != nil {
+		t.Fatal(err)
+	}
+	pool.FinishRestore()
+
+	want := []Allocation{{Port: 100, Handle: "x"}}
+	if got := pool.RefreshState().Groups["a"].Allocations; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocations %v, want %v", got, want)
+	}
+
+	for _, want := range []uint32{102, 101} {
+		if port, err := pool.Acquire("a", "new"); err != nil || port != want {
+			t.Errorf("acquired %d, %v, want %d", port, err, want)
+		}
+	}
+	if _, err := pool.Acquire("a", "new"); err != (PoolExhaustedError{}) {
+		t.Errorf("got %v, want the restored port to stay taken", err)
+	}
+}
+
+func sortedAllocations(allocations []Allocation) []Allocation {
+	sorted := append([]Allocation(nil), allocations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Port < sorted[j].Port })
+	return sorted
+}
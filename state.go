@@ -3,37 +3,132 @@ package port_pool
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 )
 
-type States []State
+// StateVersion is the version of the state file schema SaveState writes.
+// Version 1 was a bare list of per-group offsets, in layout order.
+const StateVersion = 2
 
+// State is what a pool resumes from after a restart: per group, where its
+// rotation was and which ports were handed out. Layout is the groups the
+// pool had, so that garden can keep them when it cannot resolve its layout.
 type State struct {
+	Version int                   `json:"version"`
+	Layout  []Group               `json:"layout,omitempty"`
+	Groups  map[string]GroupState `json:"groups"`
+}
+
+type GroupState struct {
+	Offset      uint32       `json:"offset"`
+	Allocations []Allocation `json:"allocations,omitempty"`
+}
+
+// Allocation is a port taken out of the pool and the handle of the container
+// it was acquired for, empty when unknown.
+type Allocation struct {
+	Port   uint32 `json:"port"`
+	Handle string `json:"handle,omitempty"`
+}
+
+// legacyState is one entry of a version 1 state file.
+type legacyState struct {
 	Offset uint32 `json:"offset"`
 }
 
-func LoadState(filePath string) (States, error) {
-	stateFile, err := os.Open(filePath)
+type UnsupportedStateVersionError struct {
+	Version int
+}
+
+func (e UnsupportedStateVersionError) Error() string {
+	return fmt.Sprintf("port pool state version %d is newer than the supported version %d", e.Version, StateVersion)
+}
+
+// LoadState reads the state file. A missing file is an empty state. A
+// version 1 file is migrated by giving its i-th offset to the i-th group of
+// layout, which is how it was written.
+func LoadState(filePath string, layout []Group) (State, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return State{Version: StateVersion}, nil
+	}
 	if err != nil {
-		return make(States,0), fmt.Errorf("openning state file: %s", err)
+		return State{}, fmt.Errorf("opening state file: %s", err)
+	}
+
+	var raw json.RawMessage
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return State{}, fmt.Errorf("parsing state file: %s", err)
+	}
+
+	if len(raw) > 0 && raw[0] == '[' {
+		var legacy []legacyState
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			return State{}, fmt.Errorf("parsing state file: %s", err)
+		}
+
+		return migrate(legacy, layout), nil
 	}
-	defer stateFile.Close()
 
-	var states States
-	if err := json.NewDecoder(stateFile).Decode(&states); err != nil {
-		return make(States,0), fmt.Errorf("parsing state file: %s", err)
+	var state State
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return State{}, fmt.Errorf("parsing state file: %s", err)
 	}
 
-	return states, nil
+	if state.Version > StateVersion {
+		return State{}, UnsupportedStateVersionError{state.Version}
+	}
+
+	return state, nil
+}
+
+func migrate(legacy []legacyState, layout []Group) State {
+	state := State{Version: StateVersion, Groups: make(map[string]GroupState)}
+	for i, entry := range legacy {
+		if i >= len(layout) {
+			break
+		}
+		state.Groups[layout[i].Name] = GroupState{Offset: entry.Offset}
+	}
+
+	return state
 }
 
-func SaveState(filePath string, state States) error {
-	stateFile, err := os.Create(filePath)
+// SaveState writes the state to a temporary file and renames it over
+// filePath, so that a crash leaves either the old or the new state.
+func SaveState(filePath string, state State) error {
+	state.Version = StateVersion
+	for name, group := range state.Groups {
+		sort.Slice(group.Allocations, func(i, j int) bool { return group.Allocations[i].Port < group.Allocations[j].Port })
+		state.Groups[name] = group
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
 	if err != nil {
 		return fmt.Errorf("creating state file: %s", err)
 	}
-	defer stateFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err := json.NewEncoder(tmpFile).Encode(state); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("writing state file: %s", err)
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("syncing state file: %s", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing state file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("renaming state file: %s", err)
+	}
 
-	json.NewEncoder(stateFile).Encode(state)
 	return nil
 }
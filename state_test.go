@@ -0,0 +1,103 @@
+package port_pool
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+var testLayout = []Group{
+	{Name: "a", Ranges: []Range{{Start: 100, Size: 10}}},
+	{Name: "b", Ranges: []Range{{Start: 200, Size: 10}}},
+}
+
+func TestLoadMissingState(t *testing.T) {
+	state, err := LoadState(filepath.Join(t.TempDir(), "port_pool.json"), testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion || len(state.Groups) != 0 {
+		t.Errorf("state %+v, want an empty one", state)
+	}
+}
+
+func TestLoadLegacyState(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "port_pool.json")
+	if err := ioutil.WriteFile(filePath, []byte(`[{"offset":5},{"offset":7},{"offset":9}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(filePath, testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]GroupState{"a": {Offset: 5}, "b": {Offset: 7}}
+	if !reflect.DeepEqual(state.Groups, want) {
+		t.Errorf("groups %+v, want %+v", state.Groups, want)
+	}
+}
+
+func TestLoadNewerState(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "port_pool.json")
+	if err := ioutil.WriteFile(filePath, []byte(`{"version":3}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadState(filePath, testLayout); err != (UnsupportedStateVersionError{3}) {
+		t.Errorf("got %v, want UnsupportedStateVersionError", err)
+	}
+}
+
+func TestPoolPersistsAllocations(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "port_pool.json")
+
+	pool, err := New(testLayout, State{}, filePath, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := pool.Acquire("a", "handle-1")
+	second, _ := pool.Acquire("a", "handle-2")
+	if err := pool.RemoveFor(205, "handle-3"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(first)
+
+	state, err := LoadState(filePath, testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(state.Layout, testLayout) {
+		t.Errorf("layout %v, want %v", state.Layout, testLayout)
+	}
+
+	want := map[string]GroupState{
+		"a": {Offset: 2, Allocations: []Allocation{{Port: second, Handle: "handle-2"}}},
+		"b": {Allocations: []Allocation{{Port: 205, Handle: "handle-3"}}},
+	}
+	if !reflect.DeepEqual(state.Groups, want) {
+		t.Errorf("groups %+v, want %+v", state.Groups, want)
+	}
+
+	restarted, err := New(testLayout, state, filePath, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restarted.Remove(second); err != (PortTakenError{second}) {
+		t.Errorf("got %v, want the restored allocation to be taken", err)
+	}
+
+	port, err := restarted.Acquire("a", "handle-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 102 {
+		t.Errorf("acquired %d, want the rotation to resume at 102", port)
+	}
+}